@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+	"github.com/KPI-KMD/lab3-term2/raft"
+)
+
+// clusterStore is a Store whose writes go through a raft log before they
+// are applied to the local Db. Reads are served by the local Db, so a
+// follower may return values the leader has already overwritten.
+type clusterStore struct {
+	node *raft.Node
+	dir  string
+	opts []datastore.Option
+
+	// mu is held for writing only while a snapshot replaces the Db.
+	mu sync.RWMutex
+	db *datastore.Db
+}
+
+// newClusterStore keeps the Db in dir/data and, unless config has a
+// storage, the raft state in dir/raft.
+func newClusterStore(dir string, config raft.Config, opts ...datastore.Option) (*clusterStore, error) {
+	s := &clusterStore{dir: filepath.Join(dir, "data"), opts: opts}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	db, err := datastore.NewDb(currentFile, s.dir, 10485760, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+
+	if config.Storage == nil {
+		if config.Storage, err = raft.NewFileStorage(filepath.Join(dir, "raft")); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	config.StateMachine = s
+	if s.node, err = raft.NewNode(config); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// parsePeers reads a comma separated list of id=url pairs.
+func parsePeers(list string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(peer), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad cluster peer %q, expected id=url", peer)
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+func (s *clusterStore) Get(key string) (string, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *clusterStore) GetInt64(key string) (int64, error) {
+	return s.GetInt64Context(context.Background(), key)
+}
+
+func (s *clusterStore) Put(key, value string) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+func (s *clusterStore) PutInt64(key string, value int64) error {
+	return s.PutInt64Context(context.Background(), key, value)
+}
+
+func (s *clusterStore) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+func (s *clusterStore) GetContext(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.GetContext(ctx, key)
+}
+
+func (s *clusterStore) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.GetInt64Context(ctx, key)
+}
+
+func (s *clusterStore) PutContext(ctx context.Context, key, value string) error {
+	return s.propose(ctx, datastore.Change{Key: key, Type: datastore.ChangePut, ValueType: "string", Value: value})
+}
+
+func (s *clusterStore) PutInt64Context(ctx context.Context, key string, value int64) error {
+	return s.propose(ctx, datastore.Change{Key: key, Type: datastore.ChangePut, ValueType: "int64", Value: fmt.Sprint(value)})
+}
+
+func (s *clusterStore) DeleteContext(ctx context.Context, key string) error {
+	return s.propose(ctx, datastore.Change{Key: key, Type: datastore.ChangeDelete})
+}
+
+func (s *clusterStore) Scan(start, end string, fn func(key, value string) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Scan(start, end, fn)
+}
+
+// ExportRange reads keys from the local Db.
+func (s *clusterStore) ExportRange(w io.Writer, start, end string, limit int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.ExportRange(w, start, end, limit)
+}
+
+// QueryIndex reads the indexes of the local Db.
+func (s *clusterStore) QueryIndex(name, value string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.QueryIndex(name, value)
+}
+
+// Stats reads the stats of the local Db.
+func (s *clusterStore) Stats() (datastore.Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Stats()
+}
+
+// Close stops the raft node and then the Db.
+func (s *clusterStore) Close() error {
+	s.node.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+func (s *clusterStore) propose(ctx context.Context, c datastore.Change) error {
+	command, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.node.Propose(ctx, command)
+}
+
+// Apply makes a committed change to the Db.
+func (s *clusterStore) Apply(command []byte) error {
+	var c datastore.Change
+	if err := json.Unmarshal(command, &c); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return applyChange(context.Background(), s.db, c)
+}
+
+// Snapshot writes a backup of the Db.
+func (s *clusterStore) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Backup(w)
+}
+
+// Restore replaces the Db with the backup read from r. The backup is
+// unpacked and opened next to the Db first, so a damaged one leaves the Db
+// as is, and the old Db is only removed once the new one is open in its
+// place.
+func (s *clusterStore) Restore(r io.Reader) error {
+	restored, replaced := s.dir+".restore", s.dir+".old"
+	if err := os.RemoveAll(restored); err != nil {
+		return err
+	}
+	if err := datastore.Restore(r, restored); err != nil {
+		return err
+	}
+	check, err := datastore.NewDb(currentFile, restored, 10485760, true, s.opts...)
+	if err != nil {
+		return err
+	}
+	if err := check.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(replaced); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.Close(); err != nil {
+		log.Printf("Failed to close the replaced database: %s", err)
+	}
+	if err := os.Rename(s.dir, replaced); err != nil {
+		return s.reopen(err)
+	}
+	if err := os.Rename(restored, s.dir); err != nil {
+		os.Rename(replaced, s.dir)
+		return s.reopen(err)
+	}
+	db, err := datastore.NewDb(currentFile, s.dir, 10485760, true, s.opts...)
+	if err != nil {
+		os.Rename(s.dir, restored)
+		os.Rename(replaced, s.dir)
+		return s.reopen(err)
+	}
+	s.db = db
+	if err := os.RemoveAll(replaced); err != nil {
+		log.Printf("Failed to remove the replaced database: %s", err)
+	}
+	log.Printf("Database restored from a raft snapshot")
+	return nil
+}
+
+// reopen opens the Db in dir again after a failed Restore, which returns
+// err so that raft tries it again.
+func (s *clusterStore) reopen(err error) error {
+	db, openErr := datastore.NewDb(currentFile, s.dir, 10485760, true, s.opts...)
+	if openErr != nil {
+		log.Printf("Failed to reopen the database after a failed restore: %s", openErr)
+		return err
+	}
+	s.db = db
+	return err
+}
+
+// redirectWrites sends the writes a follower gets to the leader with 307,
+// which keeps the method and the body.
+func redirectWrites(node *raft.Node, peers map[string]string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || node.IsLeader() {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		leader, ok := peers[node.Leader()]
+		if !ok {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(rw, r, strings.TrimSuffix(leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
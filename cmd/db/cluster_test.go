@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KPI-KMD/lab3-term2/raft"
+)
+
+func TestClusterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := raft.NewMemNetwork()
+	ids := []string{"db1", "db2", "db3"}
+	stores := make(map[string]*clusterStore)
+	for _, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		s, err := newClusterStore(filepath.Join(dir, id), raft.Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         network.Transport(id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stores[id] = s
+		network.Add(id, s.node)
+	}
+
+	var leader string
+	eventually(t, "election", func() bool {
+		for id, s := range stores {
+			if s.node.IsLeader() {
+				leader = id
+				return true
+			}
+		}
+		return false
+	})
+	var lagging string
+	for _, id := range ids {
+		if id != leader {
+			lagging = id
+		}
+	}
+
+	// The lagging node misses enough writes to need a snapshot.
+	network.Remove(lagging)
+	for i := 0; i < 20; i++ {
+		if err := stores[leader].Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stores[leader].PutInt64("count", 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[leader].Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	network.Add(lagging, stores[lagging].node)
+
+	for _, id := range ids {
+		s := stores[id]
+		eventually(t, id, func() bool {
+			v, err := s.Get("key1")
+			count, _ := s.GetInt64("count")
+			_, deleted := s.Get("key0")
+			return err == nil && v == "value19" && count == 20 && deleted != nil
+		})
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		peers := map[string]string{leader: "http://" + leader + ":8070"}
+		handler := redirectWrites(stores[lagging].node, peers, newDbHandler(stores[lagging], 0))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/key1", strings.NewReader(`{"value": "x"}`)))
+		if rw.Code != http.StatusTemporaryRedirect || rw.Header().Get("location") != peers[leader]+"/db/key1" {
+			t.Errorf("Expected a redirect to the leader, got %d %s", rw.Code, rw.Header().Get("location"))
+		}
+
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/key1", nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected the follower to serve reads, got %d", rw.Code)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		s := stores[lagging]
+		if err := s.Restore(strings.NewReader("not a backup")); err == nil {
+			t.Error("Expected a damaged backup to fail")
+		}
+		if v, err := s.Get("key1"); err != nil || v != "value19" {
+			t.Errorf("Expected the database to survive a failed restore, got %q (%v)", v, err)
+		}
+
+		var backup bytes.Buffer
+		if err := stores[leader].Snapshot(&backup); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Restore(&backup); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get("key1"); err != nil || v != "value19" {
+			t.Errorf("Bad value after a restore: %q (%v)", v, err)
+		}
+		for _, leftover := range []string{s.dir + ".old", s.dir + ".restore"} {
+			if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be gone, got %v", leftover, err)
+			}
+		}
+	})
+}
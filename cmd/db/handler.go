@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+	"github.com/KPI-KMD/lab3-term2/raft"
+)
+
+// errorStatus maps a store error to the response status.
+func errorStatus(err error) int {
+	switch err {
+	case datastore.ErrNotFound, datastore.ErrNoIndex:
+		return http.StatusNotFound
+	case datastore.ErrReservedKey:
+		return http.StatusBadRequest
+	case datastore.ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case datastore.ErrQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case context.DeadlineExceeded, context.Canceled, raft.ErrNotLeader, raft.ErrLeadershipLost:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newDbHandler serves /db/<key>: GET reads the value, POST stores the
+// "value" field of the JSON body and DELETE removes the key. GET /db/
+// reads a range of keys. /db/<namespace>/<key> and /db/<namespace>/ do
+// the same in a namespace, and DELETE /db/<namespace>/ drops it. Requests
+// waiting for the store longer than timeout fail, 0 disables the limit.
+func newDbHandler(db datastore.Store, timeout time.Duration) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		// db is replaced by the namespace the path addresses, if any.
+		parts := strings.SplitN(r.URL.Path, "/", 4)
+		db, k := db, parts[2]
+		if len(parts) == 4 {
+			ns, err := datastore.NewNamespace(db, parts[2])
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			db, k = ns, parts[3]
+			if k == "" && r.Method == http.MethodDelete {
+				log.Printf("DELETE request for namespace %s", ns.Name())
+				if err := ns.Drop(ctx); err != nil {
+					log.Printf("Failed to drop namespace %s: %s", ns.Name(), err)
+					rw.WriteHeader(errorStatus(err))
+					return
+				}
+				rw.WriteHeader(http.StatusOK)
+				return
+			}
+		} else if strings.HasPrefix(k, "\x00") {
+			// Keys of namespaces are only reached through their namespace.
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if k == "" && r.Method == http.MethodGet {
+			serveRange(rw, r, db)
+			return
+		}
+		encoder := json.NewEncoder(rw)
+
+		if r.Method == http.MethodGet {
+			log.Printf("GET request for %s", k)
+			v, err := db.GetContext(ctx, k)
+			if err != nil {
+				//log.Printf("Failed to get %s: %s", k, err)
+				if err == datastore.ErrWrongDataType {
+					v, err := db.GetInt64Context(ctx, k)
+					if err != nil {
+						log.Printf("Failed to load %s: %s", k, err)
+						rw.WriteHeader(errorStatus(err))
+						return
+					}
+
+					log.Printf("Got %s as int64", k)
+					res := struct {
+						Key   string `json:"key"`
+						Value int64  `json:"value"`
+					}{
+						Key:   k,
+						Value: v,
+					}
+					rw.WriteHeader(http.StatusOK)
+					if err := encoder.Encode(res); err != nil {
+						log.Printf("Failed to write response %d: %s", v, err)
+					}
+					return
+				}
+				rw.WriteHeader(errorStatus(err))
+				return
+			}
+
+			log.Printf("Got %s as string", k)
+			res := struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}{
+				Key:   k,
+				Value: v,
+			}
+			rw.WriteHeader(http.StatusOK)
+			if err := encoder.Encode(res); err != nil {
+				log.Printf("Failed to write response %s: %s", v, err)
+			}
+		} else if r.Method == http.MethodPost {
+			log.Printf("POST request for %s", k)
+
+			bytes, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				log.Printf("Error decoding input: %s", err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var jsonFields map[string]*json.RawMessage
+			err = json.Unmarshal(bytes, &jsonFields)
+			if err != nil {
+				log.Printf("Error decoding input: %s", err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var int64Value int64
+			err = json.Unmarshal(*jsonFields["value"], &int64Value)
+			if err != nil {
+				var stringValue string
+				err = json.Unmarshal(*jsonFields["value"], &stringValue)
+				if err != nil {
+					log.Printf("Error decoding input: %s", err)
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				log.Printf("Decoded string: %s", stringValue)
+				if err := db.PutContext(ctx, k, stringValue); err != nil {
+					rw.WriteHeader(errorStatus(err))
+					log.Printf("Failed to set %s -> \"%s\": %s", k, stringValue, err)
+					return
+				}
+				rw.WriteHeader(http.StatusOK)
+				return
+			}
+
+			log.Printf("Decoded int64: %d", int64Value)
+			if err := db.PutInt64Context(ctx, k, int64Value); err != nil {
+				rw.WriteHeader(errorStatus(err))
+				log.Printf("Failed to set %s -> %d: %s", k, int64Value, err)
+				return
+			}
+
+			rw.WriteHeader(http.StatusOK)
+		} else if r.Method == http.MethodDelete {
+			log.Printf("DELETE request for %s", k)
+			if err := db.DeleteContext(ctx, k); err != nil {
+				rw.WriteHeader(errorStatus(err))
+				log.Printf("Failed to delete %s: %s", k, err)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		}
+	}
+}
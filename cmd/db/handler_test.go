@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func TestDbHandler(t *testing.T) {
+	db := datastore.NewMemDb()
+	defer db.Close()
+	handler := newDbHandler(db, 0)
+
+	serve := func(method, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/db/"+key, strings.NewReader(body))
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+
+	requests := []struct {
+		method, key, body string
+		status            int
+		response          string
+	}{
+		{http.MethodGet, "missing", "", http.StatusNotFound, ""},
+		{http.MethodPost, "name", `{"value": "example"}`, http.StatusOK, ""},
+		{http.MethodGet, "name", "", http.StatusOK, `{"key":"name","value":"example"}`},
+		{http.MethodPost, "count", `{"value": 42}`, http.StatusOK, ""},
+		{http.MethodGet, "count", "", http.StatusOK, `{"key":"count","value":42}`},
+		{http.MethodPost, "bad", `{"value": true}`, http.StatusBadRequest, ""},
+		{http.MethodDelete, "name", "", http.StatusOK, ""},
+		{http.MethodGet, "name", "", http.StatusNotFound, ""},
+		// MemDb cannot export ranges.
+		{http.MethodGet, "", "", http.StatusNotImplemented, ""},
+	}
+	for _, r := range requests {
+		rw := serve(r.method, r.key, r.body)
+		if rw.Code != r.status {
+			t.Errorf("%s %s: expected status %d, got %d", r.method, r.key, r.status, rw.Code)
+		}
+		if got := strings.TrimSpace(rw.Body.String()); got != r.response {
+			t.Errorf("%s %s: expected response %s, got %s", r.method, r.key, r.response, got)
+		}
+	}
+}
+
+func TestDbHandler_Range(t *testing.T) {
+	db := newMemDb(t, 1000)
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, key+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("bn", 7); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	newDbHandler(db, 0)(rw, httptest.NewRequest(http.MethodGet, "/db/?start=b&end=d&limit=2", nil))
+	expected := `{"key":"b","type":"string","value":"bb"}` + "\n" + `{"key":"bn","type":"int64","value":7}` + "\n"
+	if rw.Code != http.StatusOK || rw.Body.String() != expected {
+		t.Errorf("Unexpected range response %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestDbHandler_Namespaces(t *testing.T) {
+	db := newMemDb(t, 1000)
+	defer db.Close()
+	handler := newDbHandler(db, 0)
+
+	type request struct {
+		method, path, body string
+		status             int
+		response           string
+	}
+	serve := func(requests ...request) {
+		for _, r := range requests {
+			rw := httptest.NewRecorder()
+			handler(rw, httptest.NewRequest(r.method, r.path, strings.NewReader(r.body)))
+			if rw.Code != r.status {
+				t.Errorf("%s %s: expected status %d, got %d", r.method, r.path, r.status, rw.Code)
+			}
+			if got := strings.TrimSpace(rw.Body.String()); got != r.response {
+				t.Errorf("%s %s: expected response %s, got %s", r.method, r.path, r.response, got)
+			}
+		}
+	}
+
+	serve(
+		request{http.MethodPost, "/db/team/name", `{"value": "example"}`, http.StatusOK, ""},
+		request{http.MethodPost, "/db/team/count", `{"value": 42}`, http.StatusOK, ""},
+		request{http.MethodPost, "/db/name", `{"value": "plain"}`, http.StatusOK, ""},
+		request{http.MethodGet, "/db/team/name", "", http.StatusOK, `{"key":"name","value":"example"}`},
+		request{http.MethodGet, "/db/other/name", "", http.StatusNotFound, ""},
+		request{http.MethodGet, "/db/name", "", http.StatusOK, `{"key":"name","value":"plain"}`},
+		request{http.MethodGet, "/db/team/?start=d", "", http.StatusOK, `{"key":"name","type":"string","value":"example"}`},
+		request{http.MethodPost, "/db/%00team%00name", `{"value": "forged"}`, http.StatusBadRequest, ""},
+		request{http.MethodGet, "/db/%00team%00name", "", http.StatusBadRequest, ""},
+		request{http.MethodDelete, "/db/%00team%00name", "", http.StatusBadRequest, ""},
+		request{http.MethodGet, "/db/team/name", "", http.StatusOK, `{"key":"name","value":"example"}`},
+	)
+
+	rw := httptest.NewRecorder()
+	newNamespacesHandler(db)(rw, httptest.NewRequest(http.MethodGet, "/admin/namespaces", nil))
+	expected := `[{"name":"team","keys":2,"bytes":18}]`
+	if got := strings.TrimSpace(rw.Body.String()); rw.Code != http.StatusOK || got != expected {
+		t.Errorf("Expected namespaces %s, got %d %s", expected, rw.Code, got)
+	}
+
+	serve(
+		request{http.MethodDelete, "/db/team/", "", http.StatusOK, ""},
+		request{http.MethodGet, "/db/team/count", "", http.StatusNotFound, ""},
+		request{http.MethodGet, "/db/name", "", http.StatusOK, `{"key":"name","value":"plain"}`},
+	)
+}
+
+func TestDbHandler_Quota(t *testing.T) {
+	db := newMemDb(t, 1000, datastore.WithMaxValueSize(10), datastore.WithQuota(20))
+	defer db.Close()
+	handler := newDbHandler(db, 0)
+
+	requests := []struct {
+		key, body string
+		status    int
+	}{
+		{"a", `{"value": "0123456789"}`, http.StatusOK},
+		{"b", `{"value": "0123456789a"}`, http.StatusRequestEntityTooLarge},
+		{"b", `{"value": "01234567"}`, http.StatusOK},
+		{"c", `{"value": "0"}`, http.StatusInsufficientStorage},
+	}
+	for _, r := range requests {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(http.MethodPost, "/db/"+r.key, strings.NewReader(r.body)))
+		if rw.Code != r.status {
+			t.Errorf("POST %s %s: expected status %d, got %d", r.key, r.body, r.status, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+type indexQuerier interface {
+	QueryIndex(name, value string) ([]string, error)
+}
+
+// parseIndexes reads a comma separated list of name=path secondary indexes.
+func parseIndexes(list string) ([]datastore.Option, error) {
+	var opts []datastore.Option
+	for _, index := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(index), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad index %q, expected name=path", index)
+		}
+		opts = append(opts, datastore.WithIndex(parts[0], parts[1]))
+	}
+	return opts, nil
+}
+
+// newIndexHandler serves /index/<name>?value=V[&namespace=N]: a JSON array
+// of the keys whose indexed field has value V, in namespace N if given.
+func newIndexHandler(db datastore.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var q interface{} = db
+		if name := r.URL.Query().Get("namespace"); name != "" {
+			ns, err := datastore.NewNamespace(db, name)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			q = ns
+		}
+		querier, ok := q.(indexQuerier)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		index := strings.TrimPrefix(r.URL.Path, "/index/")
+		log.Printf("Index request for %s", index)
+		keys, err := querier.QueryIndex(index, r.URL.Query().Get("value"))
+		if err != nil {
+			log.Printf("Failed to query index %s: %s", index, err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		rw.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(rw).Encode(keys); err != nil {
+			log.Printf("Failed to write response: %s", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func TestIndexHandler(t *testing.T) {
+	opts, err := parseIndexes("team=team, city=address.city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newMemDb(t, 1000, opts...)
+	defer db.Close()
+
+	users := map[string]string{
+		"alice": `{"team": "ops", "address": {"city": "Kyiv"}}`,
+		"bob":   `{"team": "dev", "address": {"city": "Lviv"}}`,
+		"carol": `{"team": "ops"}`,
+	}
+	for key, value := range users {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns, err := db.Namespace("staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Put("dave", `{"team": "ops"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newIndexHandler(db)
+	requests := []struct {
+		path     string
+		status   int
+		response string
+	}{
+		{"/index/team?value=ops", http.StatusOK, `["\u0000staff\u0000dave","alice","carol"]`},
+		{"/index/city?value=Lviv", http.StatusOK, `["bob"]`},
+		{"/index/team?value=qa", http.StatusOK, `[]`},
+		{"/index/team?value=ops&namespace=staff", http.StatusOK, `["dave"]`},
+		{"/index/missing?value=ops", http.StatusNotFound, ""},
+	}
+	for _, r := range requests {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(http.MethodGet, r.path, nil))
+		if rw.Code != r.status {
+			t.Errorf("%s: expected status %d, got %d", r.path, r.status, rw.Code)
+		}
+		if got := strings.TrimSpace(rw.Body.String()); got != r.response {
+			t.Errorf("%s: expected response %s, got %s", r.path, r.response, got)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	newIndexHandler(datastore.NewMemDb())(rw, httptest.NewRequest(http.MethodGet, "/index/team?value=ops", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without indexes, got %d", rw.Code)
+	}
+	if _, err := parseIndexes("team"); err == nil {
+		t.Errorf("Expected an index without a path to be rejected")
+	}
+}
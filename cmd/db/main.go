@@ -1,135 +1,236 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/KPI-KMD/lab3-term2/datastore"
 	"github.com/KPI-KMD/lab3-term2/httptools"
+	"github.com/KPI-KMD/lab3-term2/raft"
 	"github.com/KPI-KMD/lab3-term2/signal"
 )
 
 var dbDir = flag.String("dir", ".", "database directory")
 var port = flag.Int("port", 8070, "database server port")
+var engine = flag.String("engine", "bitcask", "storage engine: bitcask, lsm or memory")
+var diskIndex = flag.Bool("disk-index", false, "keep indexes of sealed segments on disk, not with -key-file (bitcask engine)")
+var compress = flag.Bool("compress", false, "compress sealed segments (bitcask engine)")
+var keyFile = flag.String("key-file", "", "file with hex encoded encryption keys, current key first (bitcask engine)")
+var valueThreshold = flag.Int("value-threshold", 0, "store values longer than this in a value log, 0 disables (bitcask engine)")
+var maxKeySize = flag.Int("max-key-size", 0, "longest key accepted for writes, 0 keeps the built-in limit (bitcask engine)")
+var maxValueSize = flag.Int("max-value-size", 0, "longest value accepted for writes, 0 keeps the built-in limit (bitcask engine)")
+var quota = flag.Int64("quota", 0, "most bytes of live keys and values, 0 disables (bitcask engine)")
+var namespaceQuota = flag.Int64("namespace-quota", 0, "most bytes of live keys and values in every namespace, 0 disables (bitcask engine)")
+var follow = flag.String("follow", "", "URL of a leader database server to replicate; writes are then rejected (bitcask engine)")
+var clusterID = flag.String("cluster-id", "", "id of this node in a raft cluster (bitcask engine)")
+var clusterPeers = flag.String("cluster-peers", "", "comma separated id=url of all raft cluster nodes, this one included")
+var indexes = flag.String("index", "", "comma separated name=path secondary indexes on fields of JSON values (bitcask engine)")
+var requestTimeout = flag.Duration("request-timeout", 5*time.Second, "give up on a /db/ request that waits longer, 0 disables")
 
 const currentFile = "current-data"
 
+type backuper interface {
+	BackupSince(since datastore.Checkpoint, w io.Writer) (datastore.Checkpoint, error)
+}
+
+func bitcaskOptions() ([]datastore.Option, error) {
+	var opts []datastore.Option
+	if *diskIndex {
+		opts = append(opts, datastore.WithDiskIndex())
+	}
+	if *compress {
+		opts = append(opts, datastore.WithCompression())
+	}
+	if *keyFile != "" {
+		keys, err := datastore.ReadKeyFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, datastore.WithEncryption(keys[0], keys[1:]...))
+	}
+	if *valueThreshold > 0 {
+		opts = append(opts, datastore.WithValueLog(*valueThreshold))
+	}
+	if *maxKeySize > 0 {
+		opts = append(opts, datastore.WithMaxKeySize(*maxKeySize))
+	}
+	if *maxValueSize > 0 {
+		opts = append(opts, datastore.WithMaxValueSize(*maxValueSize))
+	}
+	if *quota > 0 {
+		opts = append(opts, datastore.WithQuota(*quota))
+	}
+	if *namespaceQuota > 0 {
+		opts = append(opts, datastore.WithNamespaceQuota(*namespaceQuota))
+	}
+	if *indexes != "" {
+		indexOpts, err := parseIndexes(*indexes)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, indexOpts...)
+	}
+	return opts, nil
+}
+
+func openStore() (datastore.Store, error) {
+	switch *engine {
+	case "bitcask":
+		opts, err := bitcaskOptions()
+		if err != nil {
+			return nil, err
+		}
+		db, err := datastore.NewDb(currentFile, *dbDir, 10485760, true, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if *valueThreshold > 0 {
+			go func() {
+				for range time.Tick(time.Minute) {
+					if err := db.CollectValueLog(); err != nil {
+						log.Printf("Failed to collect value log: %s", err)
+					}
+				}
+			}()
+		}
+		return db, nil
+	case "lsm":
+		return datastore.NewLsmDb(*dbDir, 4194304)
+	case "memory":
+		return datastore.NewMemDb(), nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q", *engine)
+	}
+}
+
+// openCluster opens a bitcask Db replicated by raft with the nodes listed
+// in -cluster-peers, returning it with the peer URLs.
+func openCluster() (*clusterStore, map[string]string, error) {
+	if *engine != "bitcask" {
+		return nil, nil, fmt.Errorf("engine %s cannot run in a cluster", *engine)
+	}
+	peers, err := parsePeers(*clusterPeers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := peers[*clusterID]; !ok {
+		return nil, nil, fmt.Errorf("cluster peers do not list %s", *clusterID)
+	}
+	var others []string
+	for id := range peers {
+		if id != *clusterID {
+			others = append(others, id)
+		}
+	}
+	opts, err := bitcaskOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := newClusterStore(*dbDir, raft.Config{
+		ID:                *clusterID,
+		Peers:             others,
+		Transport:         raft.NewHTTPTransport(peers),
+		ElectionTimeout:   time.Second,
+		HeartbeatInterval: 100 * time.Millisecond,
+		SnapshotThreshold: 10000,
+	}, opts...)
+	return s, peers, err
+}
+
 func main() {
 	flag.Parse()
-	db, err := datastore.NewDb(currentFile, *dbDir, 10485760, true)
+	if *clusterID != "" && *follow != "" {
+		log.Fatal("A cluster node cannot follow a leader")
+	}
+
+	var db datastore.Store
+	var cluster *clusterStore
+	var peers map[string]string
+	var err error
+	if *clusterID != "" {
+		cluster, peers, err = openCluster()
+		db = cluster
+	} else {
+		db, err = openStore()
+	}
 	if err != nil {
 		log.Fatalf("Failed to start database: %s", err)
 	}
-	db.Put("test", "example")
+	// Followers and cluster nodes only hold what the leader writes.
+	if *follow == "" && cluster == nil {
+		db.Put("test", "example")
+	}
 	log.Printf("Database started at directory: %s", *dbDir)
 
-	h := new(http.ServeMux)
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("content-type", "application/json")
-		k := strings.Split(r.URL.Path, "/")[2]
-		encoder := json.NewEncoder(rw)
-
-		if r.Method == http.MethodGet {
-			log.Printf("GET request for %s", k)
-			v, err := db.Get(k)
-			if err != nil {
-				//log.Printf("Failed to get %s: %s", k, err)
-				if err == datastore.ErrNotFound {
-					rw.WriteHeader(http.StatusNotFound)
-				} else if err == datastore.ErrWrongDataType {
-					v, err := db.GetInt64(k)
-					if err != nil {
-						log.Printf("Failed to load %s: %s", k, err)
-						rw.WriteHeader(http.StatusInternalServerError)
-						return
-					}
-
-					log.Printf("Got %s as int64", k)
-					res := struct {
-						Key   string `json:"key"`
-						Value int64  `json:"value"`
-					}{
-						Key:   k,
-						Value: v,
-					}
-					rw.WriteHeader(http.StatusOK)
-					if err := encoder.Encode(res); err != nil {
-						log.Printf("Failed to write response %d: %s", v, err)
-					}
-					return
-				} else {
-					rw.WriteHeader(http.StatusInternalServerError)
-				}
-				return
-			}
-
-			log.Printf("Got %s as string", k)
-			res := struct {
-				Key   string `json:"key"`
-				Value string `json:"value"`
-			}{
-				Key:   k,
-				Value: v,
-			}
-			rw.WriteHeader(http.StatusOK)
-			if err := encoder.Encode(res); err != nil {
-				log.Printf("Failed to write response %s: %s", v, err)
-			}
-		} else if r.Method == http.MethodPost {
-			log.Printf("POST request for %s", k)
+	var dbHandler http.Handler = newDbHandler(db, *requestTimeout)
+	if *follow != "" {
+		r, ok := db.(replica)
+		if !ok {
+			log.Fatalf("Engine %s cannot follow a leader", *engine)
+		}
+		go newFollower(*follow, r).run(context.Background())
+		log.Printf("Following %s", *follow)
+		dbHandler = readOnly(dbHandler)
+	}
 
-			bytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				log.Printf("Error decoding input: %s", err)
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
+	h := new(http.ServeMux)
+	if cluster != nil {
+		log.Printf("Joining raft cluster as %s", *clusterID)
+		h.Handle("/raft/", raft.NewHTTPHandler(cluster.node))
+		dbHandler = redirectWrites(cluster.node, peers, dbHandler)
+	}
+	h.Handle("/db/", dbHandler)
+	h.Handle("/db/watch", httptools.NoTimeout(newWatchHandler(db)))
+	h.Handle("/admin/snapshot", httptools.NoTimeout(newSnapshotHandler(db)))
+	h.Handle("/admin/namespaces", newNamespacesHandler(db))
+	h.Handle("/index/", newIndexHandler(db))
+	h.Handle("/metrics", newMetricsHandler(db))
+
+	h.Handle("/admin/backup", httptools.NoTimeout(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		b, ok := db.(backuper)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
 
-			var jsonFields map[string]*json.RawMessage
-			err = json.Unmarshal(bytes, &jsonFields)
+		var since datastore.Checkpoint
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			since, err = datastore.ParseCheckpoint(s)
 			if err != nil {
-				log.Printf("Error decoding input: %s", err)
 				rw.WriteHeader(http.StatusBadRequest)
 				return
 			}
+		}
 
-			var int64Value int64
-			err = json.Unmarshal(*jsonFields["value"], &int64Value)
-			if err != nil {
-				var stringValue string
-				err = json.Unmarshal(*jsonFields["value"], &stringValue)
-				if err != nil {
-					log.Printf("Error decoding input: %s", err)
-					rw.WriteHeader(http.StatusBadRequest)
-					return
-				}
-
-				log.Printf("Decoded string: %s", stringValue)
-				if err := db.Put(k, stringValue); err != nil {
-					rw.WriteHeader(http.StatusInternalServerError)
-					log.Printf("Failed to set %s -> \"%s\": %s", k, stringValue, err)
-					return
-				}
-				rw.WriteHeader(http.StatusOK)
-				return
-			}
-
-			log.Printf("Decoded int64: %d", int64Value)
-			if err := db.PutInt64(k, int64Value); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				log.Printf("Failed to set %s -> %d: %s", k, int64Value, err)
-				return
-			}
-
-			rw.WriteHeader(http.StatusOK)
+		log.Printf("Backup requested since checkpoint %s", since)
+		rw.Header().Set("content-type", "application/x-tar")
+		rw.Header().Set("content-disposition", `attachment; filename="backup.tar"`)
+		checkpoint, err := b.BackupSince(since, rw)
+		if err != nil {
+			log.Printf("Failed to write backup: %s", err)
+			return
 		}
-	})
+		log.Printf("Backup written up to checkpoint %s", checkpoint)
+	})))
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
+
+	// A cluster store stops its raft node before closing the Db.
+	if err := db.Close(); err != nil {
+		log.Fatalf("Failed to close the database: %s", err)
+	}
+	log.Printf("Database closed")
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+type statser interface {
+	Stats() (datastore.Stats, error)
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	out *bufio.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) value(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(m.out, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (m metricsWriter) metric(name, kind, help string, v float64) {
+	m.header(name, kind, help)
+	m.value(name, "", v)
+}
+
+func (m metricsWriter) histogram(name, help string, l datastore.Latency) {
+	m.header(name, "histogram", help)
+	for i, bound := range datastore.LatencyBuckets {
+		m.value(name+"_bucket", fmt.Sprintf(`le="%s"`, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)), float64(l.Buckets[i]))
+	}
+	m.value(name+"_bucket", `le="+Inf"`, float64(l.Count))
+	m.value(name+"_sum", "", l.Total.Seconds())
+	m.value(name+"_count", "", float64(l.Count))
+}
+
+// newMetricsHandler serves /metrics: the Stats of the store in the
+// Prometheus text format.
+func newMetricsHandler(db datastore.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := db.(statser)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		stats, err := s.Stats()
+		if err != nil {
+			log.Printf("Failed to read stats: %s", err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+
+		rw.Header().Set("content-type", "text/plain; version=0.0.4")
+		m := metricsWriter{out: bufio.NewWriter(rw)}
+		m.metric("db_keys", "gauge", "Live keys.", float64(stats.Keys))
+		m.metric("db_segments", "gauge", "Sealed segments.", float64(stats.Segments))
+		m.metric("db_index_entries", "gauge", "Keys held in memory by indexes.", float64(stats.IndexEntries))
+		m.metric("db_live_bytes", "gauge", "Bytes of the latest records of keys.", float64(stats.LiveBytes))
+		m.metric("db_dead_bytes", "gauge", "Bytes a merge would drop.", float64(stats.DeadBytes))
+		m.metric("db_merges_total", "counter", "Segment merges run.", float64(stats.Merges))
+		m.metric("db_merge_seconds_total", "counter", "Time spent merging segments.", stats.MergeTime.Seconds())
+		m.metric("db_merge_reclaimed_bytes_total", "counter", "Bytes freed by merges.", float64(stats.ReclaimedBytes))
+		m.histogram("db_put_duration_seconds", "Time writes took until they were on disk.", stats.Puts)
+		m.histogram("db_write_queue_seconds", "Time writes waited for the writer.", stats.QueueWait)
+		m.histogram("db_get_duration_seconds", "Time reads took.", stats.Gets)
+		if err := m.out.Flush(); err != nil {
+			log.Printf("Failed to write metrics: %s", err)
+		}
+	}
+}
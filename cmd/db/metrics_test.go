@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db := newMemDb(t, 1000)
+	defer db.Close()
+	for _, key := range []string{"a", "b", "a"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	newMetricsHandler(db)(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	body := rw.Body.String()
+	for _, line := range []string{
+		"# TYPE db_keys gauge",
+		"db_keys 2",
+		"db_segments 0",
+		"db_live_bytes 46",
+		"db_dead_bytes 23",
+		"# TYPE db_put_duration_seconds histogram",
+		`db_put_duration_seconds_bucket{le="+Inf"} 3`,
+		"db_put_duration_seconds_count 3",
+		"db_get_duration_seconds_count 1",
+		"db_merges_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, body)
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	newMetricsHandler(datastore.NewMemDb())(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without stats, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+// newNamespacesHandler serves /admin/namespaces: the names of the
+// namespaces with keys and how many keys and bytes each holds.
+func newNamespacesHandler(db datastore.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := datastore.Namespaces(db)
+		if err != nil {
+			log.Printf("Failed to count namespaces: %s", err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		if stats == nil {
+			stats = []datastore.NamespaceStats{}
+		}
+		rw.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(rw).Encode(stats); err != nil {
+			log.Printf("Failed to write response: %s", err)
+		}
+	}
+}
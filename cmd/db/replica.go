@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+const sequenceTrailer = "X-Sequence"
+
+var errSnapshotNeeded = fmt.Errorf("changes are no longer in the leader log")
+
+type snapshotter interface {
+	Snapshot(w io.Writer) (uint64, error)
+}
+
+// newSnapshotHandler serves /admin/snapshot: an export of all keys in
+// JSON Lines, followed by the sequence to watch from in the X-Sequence
+// trailer. A response without the trailer is incomplete.
+func newSnapshotHandler(db datastore.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := db.(snapshotter)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.Header().Set("trailer", sequenceTrailer)
+		seq, err := s.Snapshot(rw)
+		if err != nil {
+			log.Printf("Failed to write snapshot: %s", err)
+			return
+		}
+		rw.Header().Set(sequenceTrailer, strconv.FormatUint(seq, 10))
+		log.Printf("Snapshot written up to sequence %d", seq)
+	}
+}
+
+// readOnly rejects requests other than GET, for followers that only take
+// writes from their leader.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("allow", http.MethodGet)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+type replica interface {
+	datastore.Store
+	Replace(r io.Reader) error
+}
+
+// follower keeps a replica in sync with a leader. It streams the leader's
+// changes from /db/watch and loads a snapshot first, or again whenever the
+// leader no longer has the changes since the last one applied. The
+// sequence is only kept in memory, so a restarted follower starts from a
+// snapshot too.
+type follower struct {
+	leader     string
+	db         replica
+	client     *http.Client
+	retryDelay time.Duration
+	seq        uint64
+}
+
+func newFollower(leader string, db replica) *follower {
+	return &follower{
+		leader:     strings.TrimSuffix(leader, "/"),
+		db:         db,
+		client:     http.DefaultClient,
+		retryDelay: time.Second,
+	}
+}
+
+// run replicates until ctx is done, reconnecting after failures.
+func (f *follower) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := f.sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Replication from %s interrupted: %s", f.leader, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(f.retryDelay):
+		}
+	}
+}
+
+func (f *follower) sync(ctx context.Context) error {
+	if f.seq == 0 {
+		if err := f.loadSnapshot(ctx); err != nil {
+			return err
+		}
+		log.Printf("Loaded snapshot of %s up to sequence %d", f.leader, f.seq)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/db/watch?since=%d", f.leader, f.seq), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		f.seq = 0
+		return errSnapshotNeeded
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+
+	in := bufio.NewReader(resp.Body)
+	for {
+		c, err := readChange(in)
+		if err != nil {
+			return err
+		}
+		if err := applyChange(ctx, f.db, c); err != nil {
+			return err
+		}
+		f.seq = c.Sequence
+	}
+}
+
+// loadSnapshot replaces the replica keys with a snapshot streamed from
+// the leader. Nothing of it is written to disk apart from the replica
+// itself, and a download cut short fails before Replace deletes keys.
+func (f *follower) loadSnapshot(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+"/admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+
+	if err := f.db.Replace(trailerReader{resp}); err != nil {
+		return err
+	}
+	seq, err := strconv.ParseUint(resp.Trailer.Get(sequenceTrailer), 10, 64)
+	if err != nil {
+		return fmt.Errorf("incomplete snapshot: %s", err)
+	}
+	f.seq = seq
+	return nil
+}
+
+// trailerReader reads a snapshot response body. The trailer only arrives
+// with the end of the body, so a body without it ends in
+// io.ErrUnexpectedEOF instead of io.EOF.
+type trailerReader struct {
+	resp *http.Response
+}
+
+func (r trailerReader) Read(p []byte) (int, error) {
+	n, err := r.resp.Body.Read(p)
+	if err == io.EOF && r.resp.Trailer.Get(sequenceTrailer) == "" {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// applyChange makes the change described by c to db.
+func applyChange(ctx context.Context, db datastore.Store, c datastore.Change) error {
+	if name, key, ok := datastore.SplitNamespaceKey(c.Key); ok {
+		ns, err := datastore.NewNamespace(db, name)
+		if err != nil {
+			return err
+		}
+		db, c.Key = ns, key
+	}
+	switch {
+	case c.Type == datastore.ChangeDelete:
+		return db.DeleteContext(ctx, c.Key)
+	case c.ValueType == "int64":
+		v, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return db.PutInt64Context(ctx, c.Key, v)
+	default:
+		return db.PutContext(ctx, c.Key, c.Value)
+	}
+}
+
+// readChange reads server-sent events until a change arrives.
+func readChange(in *bufio.Reader) (datastore.Change, error) {
+	var event, data string
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return datastore.Change{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				data = strings.TrimPrefix(line, "data: ")
+			}
+			continue
+		}
+		if event == "change" {
+			var c datastore.Change
+			err := json.Unmarshal([]byte(data), &c)
+			return c, err
+		}
+		event, data = "", ""
+	}
+}
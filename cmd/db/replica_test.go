@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func newMemDb(t *testing.T, size int, opts ...datastore.Option) *datastore.Db {
+	fs := datastore.NewMemFS()
+	if err := fs.MkdirAll("db", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(currentFile, "db", size, true, append(opts, datastore.WithFS(fs))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// eventually retries check until it succeeds or a few seconds pass.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !check(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not catch up: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	leader := newMemDb(t, 500)
+	defer leader.Close()
+	replicaDb := newMemDb(t, 500)
+	defer replicaDb.Close()
+
+	h := new(http.ServeMux)
+	h.Handle("/db/watch", newWatchHandler(leader))
+	h.Handle("/admin/snapshot", newSnapshotHandler(leader))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	if err := leader.Put("before", "start"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicaDb.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	f := newFollower(server.URL, replicaDb)
+	f.retryDelay = 10 * time.Millisecond
+	go func() {
+		f.run(ctx)
+		close(done)
+	}()
+
+	has := func(key, value string) func() bool {
+		return func() bool {
+			v, err := replicaDb.Get(key)
+			return err == nil && v == value
+		}
+	}
+	eventually(t, "snapshot", has("before", "start"))
+	if _, err := replicaDb.Get("stale"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the snapshot to delete stale, got %v", err)
+	}
+
+	if err := leader.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.PutInt64("count", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Delete("before"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "changes", func() bool {
+		_, err := replicaDb.Get("before")
+		v, _ := replicaDb.GetInt64("count")
+		return err == datastore.ErrNotFound && v == 3 && has("key", "value1")()
+	})
+
+	// Changes made while the follower is away roll the leader log over,
+	// so it has to load a snapshot again.
+	server.Config.SetKeepAlivesEnabled(false)
+	server.CloseClientConnections()
+	for i := 0; i < 50; i++ {
+		if err := leader.Put("key", "value2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "reconnect", has("key", "value2"))
+}
+
+func TestFollower_IncompleteSnapshot(t *testing.T) {
+	replicaDb := newMemDb(t, 500)
+	defer replicaDb.Close()
+	if err := replicaDb.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A leader that stops after the first record sends no sequence.
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("trailer", sequenceTrailer)
+		fmt.Fprintln(rw, `{"key":"key","type":"string","value":"value"}`)
+	}))
+	defer server.Close()
+
+	f := newFollower(server.URL, replicaDb)
+	if err := f.loadSnapshot(context.Background()); err == nil {
+		t.Error("Expected an incomplete snapshot to fail")
+	}
+	if v, err := replicaDb.Get("stale"); err != nil || v != "value" {
+		t.Errorf("Expected an incomplete snapshot to keep stale, got %s (%v)", v, err)
+	}
+	if f.seq != 0 {
+		t.Errorf("Expected no sequence after an incomplete snapshot, got %d", f.seq)
+	}
+}
+
+func TestApplyChange_Namespace(t *testing.T) {
+	db := newMemDb(t, 1000)
+	defer db.Close()
+	ctx := context.Background()
+
+	key := datastore.NamespaceKey("team", "name")
+	if err := applyChange(ctx, db, datastore.Change{Key: key, Type: datastore.ChangePut, ValueType: "string", Value: "example"}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := db.Namespace("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ns.Get("name"); err != nil || v != "example" {
+		t.Errorf("Bad value in the namespace: %q (%v)", v, err)
+	}
+	if err := applyChange(ctx, db, datastore.Change{Key: key, Type: datastore.ChangeDelete}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Get("name"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+}
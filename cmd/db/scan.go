@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+type rangeExporter interface {
+	ExportRange(w io.Writer, start, end string, limit int) error
+}
+
+// serveRange answers GET /db/?start=&end=&limit= with the keys in
+// [start, end) as JSON Lines in the export format, at most limit of them.
+// Clients read a long range page by page, starting each one right after
+// the last key they got.
+func serveRange(rw http.ResponseWriter, r *http.Request, db datastore.Store) {
+	e, ok := db.(rangeExporter)
+	if !ok {
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Range request for [%q, %q)", q.Get("start"), q.Get("end"))
+	rw.Header().Set("content-type", "application/x-ndjson")
+	if err := e.ExportRange(rw, q.Get("start"), q.Get("end"), limit); err != nil {
+		log.Printf("Failed to export range: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+type watcher interface {
+	Watch(ctx context.Context, prefix string, since uint64) (<-chan datastore.Change, error)
+}
+
+// newWatchHandler serves /db/watch?prefix=&since= as server-sent events,
+// one "change" event per write with the sequence as its id. Reconnecting
+// clients resume after the Last-Event-ID they send; 410 means the changes
+// since then are gone and the keys have to be read again.
+func newWatchHandler(db datastore.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w, ok := db.(watcher)
+		flusher, canFlush := rw.(http.Flusher)
+		if !ok || !canFlush {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		since := r.URL.Query().Get("since")
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			since = id
+		}
+		var from uint64
+		if since != "" {
+			var err error
+			if from, err = strconv.ParseUint(since, 10, 64); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		prefix := r.URL.Query().Get("prefix")
+		changes, err := w.Watch(r.Context(), prefix, from)
+		if err == datastore.ErrWatchExpired {
+			rw.WriteHeader(http.StatusGone)
+			return
+		} else if err != nil {
+			log.Printf("Failed to watch %q: %s", prefix, err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+
+		log.Printf("Watching %q since %d", prefix, from)
+		rw.Header().Set("content-type", "text/event-stream")
+		rw.Header().Set("cache-control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for c := range changes {
+			data, err := json.Marshal(c)
+			if err != nil {
+				log.Printf("Failed to encode change of %s: %s", c.Key, err)
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: change\ndata: %s\n\n", c.Sequence, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
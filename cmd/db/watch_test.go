@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func TestWatchHandler(t *testing.T) {
+	fs := datastore.NewMemFS()
+	if err := fs.MkdirAll("db", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(currentFile, "db", 1000, false, datastore.WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server := httptest.NewServer(newWatchHandler(db))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/watch?prefix=user/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	if err := db.Put("other", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user/1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(resp.Body)
+	var event []string
+	for len(event) < 3 {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		event = append(event, strings.TrimSpace(line))
+	}
+	if !strings.HasPrefix(event[0], "id: ") || event[1] != "event: change" ||
+		!strings.Contains(event[2], `"key":"user/1","type":"put","valueType":"string","value":"alice"`) {
+		t.Errorf("Unexpected event %q", event)
+	}
+
+	// Sequence 1 precedes every record of the first current file.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/db/watch", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	in = bufio.NewReader(resumed.Body)
+	for i := 0; i < 3; i++ {
+		if event[i], err = in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(event[2], `"key":"other"`) {
+		t.Errorf("Expected the replay to start with other, got %q", event[2])
+	}
+
+	bad, err := http.Get(server.URL + "/db/watch?since=latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad sequence, got %d", bad.StatusCode)
+	}
+
+	unsupported := httptest.NewRecorder()
+	newWatchHandler(datastore.NewMemDb())(unsupported, httptest.NewRequest(http.MethodGet, "/db/watch", nil))
+	if unsupported.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501 for a store without watches, got %d", unsupported.Code)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func runCheck(args []string) error {
+	return checkDir("check", args, datastore.Check)
+}
+
+func runRepair(args []string) error {
+	return checkDir("repair", args, datastore.Repair)
+}
+
+func checkDir(name string, args []string, check func(string, ...datastore.Option) (*datastore.CheckReport, error)) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	_ = fs.Parse(args)
+
+	opts, err := dbf.options()
+	if err != nil {
+		return err
+	}
+	report, err := check(*dbf.dir, opts...)
+	if errors.Is(err, datastore.ErrEncrypted) {
+		return fmt.Errorf("%w, pass -key-file", err)
+	} else if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d files, %d records, %d problems\n", report.Files, report.Records, len(report.Problems))
+	if !report.OK() {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file with hex encoded encryption keys")
+	maxValue := fs.Int("max-value", 40, "longest value to print in full")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one file to dump")
+	}
+
+	opts, err := keyOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tSIZE\tTYPE\tKEY\tVALUE")
+	err = datastore.ReadRecords(fs.Arg(0), func(r datastore.RecordInfo) error {
+		typ := r.Type
+		if r.Encrypted {
+			typ += " (enc)"
+		}
+		value := r.Value
+		if len(value) > *maxValue {
+			value = value[:*maxValue] + "..."
+		}
+		_, err := fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", r.Offset, r.Size, typ, strconv.Quote(r.Key), strconv.Quote(value))
+		return err
+	}, opts...)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	_ = fs.Parse(args)
+
+	opts, err := dbf.options()
+	if err != nil {
+		return err
+	}
+	stats, err := datastore.DirStats(*dbf.dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tRECORDS\tKEYS\tLIVE\tDEAD\tTYPES")
+	for _, s := range stats {
+		types := make([]string, 0, len(s.Types))
+		for t, n := range s.Types {
+			types = append(types, fmt.Sprintf("%s=%d", t, n))
+		}
+		sort.Strings(types)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", s.Name, s.Records, s.Keys, s.LiveBytes, s.DeadBytes, strings.Join(types, " "))
+	}
+	return w.Flush()
+}
+
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one key")
+	}
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	value, err := db.Get(fs.Arg(0))
+	if err == datastore.ErrWrongDataType {
+		var n int64
+		n, err = db.GetInt64(fs.Arg(0))
+		value = strconv.FormatInt(n, 10)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
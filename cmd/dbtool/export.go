@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	out := fs.String("out", "", "output file, standard output by default")
+	_ = fs.Parse(args)
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return db.Export(w)
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	in := fs.String("in", "", "input file, standard input by default")
+	_ = fs.Parse(args)
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r := os.Stdin
+	if *in != "" {
+		r, err = os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	return db.Import(r)
+}
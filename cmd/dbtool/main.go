@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+const currentFile = "current-data"
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"export":  {"export -dir DIR [-out FILE]", runExport},
+	"import":  {"import -dir DIR [-in FILE]", runImport},
+	"check":   {"check -dir DIR", runCheck},
+	"repair":  {"repair -dir DIR", runRepair},
+	"dump":    {"dump [-key-file FILE] [-max-value N] FILE", runDump},
+	"stats":   {"stats -dir DIR", runStats},
+	"get":     {"get -dir DIR KEY", runGet},
+	"upgrade": {"upgrade -dir DIR", runUpgrade},
+	"reshard": {"reshard -from URLS -to URLS [-vnodes N] [-batch N] [-dry-run]", runReshard},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: dbtool COMMAND [FLAGS]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %s", os.Args[1], err)
+	}
+}
+
+// dbFlags are the flags of commands that open a stopped database.
+type dbFlags struct {
+	dir         *string
+	segmentSize *int
+	keyFile     *string
+}
+
+func addDbFlags(fs *flag.FlagSet) *dbFlags {
+	return &dbFlags{
+		dir:         fs.String("dir", ".", "database directory"),
+		segmentSize: fs.Int("segment-size", 10485760, "segment size the database was created with"),
+		keyFile:     fs.String("key-file", "", "file with hex encoded encryption keys"),
+	}
+}
+
+func (f *dbFlags) options() ([]datastore.Option, error) {
+	return keyOptions(*f.keyFile)
+}
+
+func keyOptions(keyFile string) ([]datastore.Option, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	keys, err := datastore.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []datastore.Option{datastore.WithEncryption(keys[0], keys[1:]...)}, nil
+}
+
+func (f *dbFlags) open() (*datastore.Db, error) {
+	opts, err := f.options()
+	if err != nil {
+		return nil, err
+	}
+	// Values already moved to a value log can only be read with it open.
+	// New values only go there if they are larger than a whole segment.
+	if logs, _ := filepath.Glob(filepath.Join(*f.dir, "vlog-*")); len(logs) > 0 {
+		opts = append(opts, datastore.WithValueLog(*f.segmentSize))
+	}
+	return datastore.NewDb(currentFile, *f.dir, *f.segmentSize, false, opts...)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/KPI-KMD/lab3-term2/dbclient"
+)
+
+// runReshard moves keys between servers with dbclient.Reshard. Clients
+// should stop writing until it is done, or late writes to the old servers
+// are lost.
+func runReshard(args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	from := fs.String("from", "", "comma separated base urls of the db servers keys are on now")
+	to := fs.String("to", "", "comma separated base urls of the db servers keys should be on")
+	vnodes := fs.Int("vnodes", dbclient.DefaultVirtualNodes, "virtual nodes of every server on the ring")
+	batch := fs.Int("batch", 1000, "keys to read from a server at once")
+	dryRun := fs.Bool("dry-run", false, "only print which share of the keys would move")
+	_ = fs.Parse(args)
+	if *from == "" || *to == "" {
+		return fmt.Errorf("both -from and -to are required")
+	}
+	if *batch <= 0 {
+		return fmt.Errorf("-batch must be positive")
+	}
+
+	oldRing := dbclient.NewRing(*vnodes, strings.Split(*from, ",")...)
+	newRing := dbclient.NewRing(*vnodes, strings.Split(*to, ",")...)
+	total := 0.0
+	for _, m := range dbclient.Moves(oldRing, newRing) {
+		fmt.Printf("%s -> %s: %.1f%% of keys\n", m.From, m.To, m.Share*100)
+		total += m.Share
+	}
+	fmt.Printf("%.1f%% of keys move\n", total*100)
+	if *dryRun {
+		return nil
+	}
+
+	moved, err := dbclient.NewClient(newRing).Reshard(context.Background(), oldRing, newRing, *batch)
+	fmt.Printf("%d keys moved\n", moved)
+	return err
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/KPI-KMD/lab3-term2/datastore"
+)
+
+func runUpgrade(args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	dbf := addDbFlags(fs)
+	_ = fs.Parse(args)
+
+	opts, err := dbf.options()
+	if err != nil {
+		return err
+	}
+	upgraded, err := datastore.Upgrade(*dbf.dir, opts...)
+	for _, name := range upgraded {
+		fmt.Printf("upgraded %s\n", name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d files upgraded\n", len(upgraded))
+	return nil
+}
@@ -9,19 +9,37 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/KPI-KMD/lab3-term2/dbclient"
 	"github.com/KPI-KMD/lab3-term2/httptools"
 	"github.com/KPI-KMD/lab3-term2/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
 var db = flag.String("db", "http://database:8070/db/", "database url")
+var dbShards = flag.String("db-shards", "", "comma separated base urls of db servers to spread keys across, instead of -db")
+var dbVnodes = flag.Int("db-vnodes", dbclient.DefaultVirtualNodes, "virtual nodes of every db server on the -db-shards ring")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
+// dbURL returns the url of key on the db server that stores it.
+func dbURL(ring *dbclient.Ring, key string) string {
+	if ring == nil {
+		return *db + key
+	}
+	return dbclient.NewClient(ring).URL(key)
+}
+
 func main() {
+	flag.Parse()
+	var ring *dbclient.Ring
+	if *dbShards != "" {
+		ring = dbclient.NewRing(*dbVnodes, strings.Split(*dbShards, ",")...)
+	}
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -52,7 +70,7 @@ func main() {
 			return
 		}
 
-		v, err := http.Get(*db + k[0])
+		v, err := http.Get(dbURL(ring, k[0]))
 		if err != nil {
 			log.Printf("Failed to get data from db: %s", err)
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -88,7 +106,7 @@ func main() {
 	t := time.Now().Format("2006-01-02")
 	body := []byte(fmt.Sprintf(`{"value": "%s"}`, t))
 	r, err := http.Post(
-		*db+"KPI-KMD",
+		dbURL(ring, "KPI-KMD"),
 		"application/json",
 		bytes.NewBuffer(body))
 	if err != nil {
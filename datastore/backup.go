@@ -0,0 +1,377 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const checksumsFile = "checksums"
+
+var ErrBackupChecksum = fmt.Errorf("backup checksum mismatch")
+var ErrCheckpointMismatch = fmt.Errorf("incremental backup does not continue the restored checkpoint")
+
+// Checkpoint identifies the state of a Db captured by a backup. Segments
+// numbered up to Segment and value log files before ValueLog never change
+// afterwards, so an incremental backup can leave them out.
+type Checkpoint struct {
+	Segment  int
+	ValueLog int
+}
+
+func (c Checkpoint) String() string {
+	return fmt.Sprintf("%d.%d", c.Segment, c.ValueLog)
+}
+
+func ParseCheckpoint(s string) (Checkpoint, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return Checkpoint{}, fmt.Errorf("bad checkpoint %q", s)
+	}
+	segment, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("bad checkpoint %q", s)
+	}
+	valueLog, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("bad checkpoint %q", s)
+	}
+	return Checkpoint{Segment: segment, ValueLog: valueLog}, nil
+}
+
+type backupFile struct {
+	name string
+	file File
+	size int64
+}
+
+// snapshot opens the files of the live database changed since the given
+// checkpoint and records how much of each belongs to it right now. Open
+// handles stay readable even if a later merge removes the files, so the
+// copy can be made without holding the lock.
+func (db *Db) snapshot(since Checkpoint) ([]backupFile, manifest, error) {
+	var files []backupFile
+	add := func(path string, size int64) error {
+		f, err := openRead(db.fs, path)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			size = info.Size()
+		}
+		files = append(files, backupFile{name: filepath.Base(path), file: f, size: size})
+		return nil
+	}
+	fail := func(err error) ([]backupFile, manifest, error) {
+		closeBackupFiles(files)
+		return nil, manifest{}, err
+	}
+
+	m := db.manifest()
+	m.since = since
+	m.checkpoint = Checkpoint{Segment: db.nextSegment}
+
+	for _, seg := range db.segments {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(seg.outPath), outFileName))
+		if err == nil && n <= since.Segment {
+			continue
+		}
+		if err := add(seg.outPath, -1); err != nil {
+			return fail(err)
+		}
+	}
+	if db.vlog != nil {
+		m.checkpoint.ValueLog = db.vlog.currentID()
+		for _, id := range db.vlog.files {
+			m.valueLogs = append(m.valueLogs, filepath.Base(db.vlog.path(id)))
+			if id < since.ValueLog {
+				continue
+			}
+			size := int64(-1)
+			if id == db.vlog.currentID() {
+				size = db.vlog.offset
+			}
+			if err := add(db.vlog.path(id), size); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := add(db.outPath, db.outOffset); err != nil {
+		return fail(err)
+	}
+	return files, m, nil
+}
+
+func closeBackupFiles(files []backupFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// Backup writes a consistent tar archive of the database to w while it
+// keeps serving reads and writes. The archive holds the manifest, the
+// sealed segments, value log files, the current file and their checksums.
+func (db *Db) Backup(w io.Writer) error {
+	_, err := db.BackupSince(Checkpoint{}, w)
+	return err
+}
+
+// BackupSince writes an archive with only the files changed since the
+// checkpoint of an earlier backup, and returns the checkpoint of this
+// one. The zero checkpoint produces a full backup.
+func (db *Db) BackupSince(since Checkpoint, w io.Writer) (Checkpoint, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return Checkpoint{}, ErrClosed
+	}
+	files, m, err := db.snapshot(since)
+	db.mu.Unlock()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer closeBackupFiles(files)
+
+	tw := tar.NewWriter(w)
+	var sums bytes.Buffer
+	write := func(name string, size int64, content io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0o600,
+			Size:    size,
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(tw, io.TeeReader(content, h)); err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+		return nil
+	}
+
+	data := m.encode()
+	if err := write(manifestFile, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return Checkpoint{}, err
+	}
+	for _, f := range files {
+		if err := write(f.name, f.size, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+			return Checkpoint{}, err
+		}
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    checksumsFile,
+		Mode:    0o600,
+		Size:    int64(sums.Len()),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if _, err := tw.Write(sums.Bytes()); err != nil {
+		return Checkpoint{}, err
+	}
+	return m.checkpoint, tw.Close()
+}
+
+// Restore unpacks an archive written by Backup into dir, which must be
+// empty or missing, and checks every file against the recorded checksums.
+// Nothing is left in dir if the archive turns out to be damaged.
+func Restore(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("restore directory %s is not empty", dir)
+	}
+
+	sums, expected, err := unpackBackup(r, dir)
+	if err == nil {
+		err = verifyChecksums(sums, expected)
+	}
+	if err != nil {
+		for name := range sums {
+			os.Remove(filepath.Join(dir, name))
+		}
+		return err
+	}
+	return nil
+}
+
+// RestoreIncremental applies an archive written by BackupSince on top of
+// a directory restored from the backup whose checkpoint it continues.
+// Segments merged away in the meantime are removed from dir.
+func RestoreIncremental(r io.Reader, dir string) error {
+	base, err := readManifest(osFS{}, dir)
+	if err != nil {
+		return err
+	}
+
+	staging := filepath.Join(dir, "incremental.tmp")
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.Mkdir(staging, 0o700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	sums, expected, err := unpackBackup(r, staging)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksums(sums, expected); err != nil {
+		return err
+	}
+	m, err := readManifest(osFS{}, staging)
+	if err != nil {
+		return err
+	}
+	if m.since != base.checkpoint {
+		return ErrCheckpointMismatch
+	}
+
+	for name := range sums {
+		if name == manifestFile {
+			continue
+		}
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(filepath.Join(staging, manifestFile), filepath.Join(dir, manifestFile)); err != nil {
+		return err
+	}
+	return pruneRestored(dir, m)
+}
+
+// RestoreChain restores a full backup followed by incremental ones, in
+// the order they were taken.
+func RestoreChain(dir string, full io.Reader, incrementals ...io.Reader) error {
+	if err := Restore(full, dir); err != nil {
+		return err
+	}
+	for _, r := range incrementals {
+		if err := RestoreIncremental(r, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRestored removes segment and value log files that the manifest no
+// longer refers to.
+func pruneRestored(dir string, m manifest) error {
+	live := make(map[string]bool)
+	for _, name := range append(m.segments, m.valueLogs...) {
+		live[name] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, outFileName) && !strings.HasPrefix(name, valueLogPrefix) {
+			continue
+		}
+		if live[strings.TrimSuffix(name, indexFileSuffix)] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpackBackup(r io.Reader, dir string) (map[string]string, map[string]string, error) {
+	tr := tar.NewReader(r)
+	sums := make(map[string]string)
+	var expected map[string]string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return sums, expected, nil
+		} else if err != nil {
+			return sums, expected, err
+		}
+
+		name := hdr.Name
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return sums, expected, fmt.Errorf("unexpected file %q in backup", name)
+		}
+		if name == checksumsFile {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return sums, expected, err
+			}
+			expected = parseChecksums(data)
+			continue
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return sums, expected, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+		if err != nil {
+			return sums, expected, err
+		}
+	}
+}
+
+func parseChecksums(data []byte) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			res[fields[1]] = fields[0]
+		}
+	}
+	return res
+}
+
+func verifyChecksums(sums, expected map[string]string) error {
+	if expected == nil {
+		return fmt.Errorf("%w: no checksums in backup", ErrBackupChecksum)
+	}
+	for name, sum := range expected {
+		if sums[name] != sum {
+			return fmt.Errorf("%w: %s", ErrBackupChecksum, name)
+		}
+	}
+	for name := range sums {
+		if _, ok := expected[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrBackupChecksum, name)
+		}
+	}
+	return nil
+}
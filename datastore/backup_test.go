@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_BackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		for k := 0; k < 20; k++ {
+			if err := db.Put(fmt.Sprintf("key%d", k), fmt.Sprintf("value%d-%d", k, i)); err != nil {
+				t.Fatalf("Cannot put key%d: %s", k, err)
+			}
+		}
+	}
+	if err := db.PutInt64("number", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	done := make(chan error)
+	go func() {
+		for k := 0; k < 20; k++ {
+			if err := db.Put(fmt.Sprintf("later%d", k), "value"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		restoreDir := filepath.Join(dir, "restored")
+		if err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDb(currentFile, restoreDir, 300, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for k := 0; k < 20; k++ {
+			value, err := restored.Get(fmt.Sprintf("key%d", k))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", k, err)
+			}
+			if value != fmt.Sprintf("value%d-1", k) {
+				t.Errorf("Bad value returned for key%d: %s", k, value)
+			}
+		}
+		if v, err := restored.GetInt64("number"); err != nil || v != 5 {
+			t.Errorf("Bad int64 value %d (%v)", v, err)
+		}
+	})
+
+	t.Run("damaged archive", func(t *testing.T) {
+		damaged := append([]byte(nil), archive.Bytes()...)
+		i := bytes.Index(damaged, []byte("value3-1"))
+		if i < 0 {
+			t.Fatal("Value not found in archive")
+		}
+		damaged[i] = 'X'
+
+		restoreDir := filepath.Join(dir, "damaged")
+		err := Restore(bytes.NewReader(damaged), restoreDir)
+		if !errors.Is(err, ErrBackupChecksum) {
+			t.Fatalf("Expected checksum error, got %v", err)
+		}
+		files, _ := ioutil.ReadDir(restoreDir)
+		if len(files) != 0 {
+			t.Errorf("Damaged restore left %d files", len(files))
+		}
+	})
+}
+
+func TestDb_IncrementalBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(currentFile, dataDir, 300, true, WithValueLog(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]string)
+	put := func(round int) {
+		for k := 0; k < 15; k++ {
+			key := fmt.Sprintf("key%d", (k+round*7)%30)
+			value := fmt.Sprintf("value%d-%d", k, round)
+			if k%5 == 0 {
+				value += string(bytes.Repeat([]byte("x"), 50))
+			}
+			if err := db.Put(key, value); err != nil {
+				t.Fatalf("Cannot put %s: %s", key, err)
+			}
+			expected[key] = value
+		}
+	}
+
+	var full, first, second bytes.Buffer
+	put(0)
+	checkpoint, err := db.BackupSince(Checkpoint{}, &full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(1)
+	checkpoint, err = db.BackupSince(checkpoint, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(2)
+	put(3)
+	if _, err := db.BackupSince(checkpoint, &second); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore chain", func(t *testing.T) {
+		restoreDir := filepath.Join(dir, "restored")
+		err := RestoreChain(restoreDir, bytes.NewReader(full.Bytes()),
+			bytes.NewReader(first.Bytes()), bytes.NewReader(second.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDb(currentFile, restoreDir, 300, true, WithValueLog(40))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for key, value := range expected {
+			got, err := restored.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if got != value {
+				t.Errorf("Bad value returned for %s: expected %s, got %s", key, value, got)
+			}
+		}
+	})
+
+	t.Run("broken chain", func(t *testing.T) {
+		err := RestoreChain(filepath.Join(dir, "broken"), bytes.NewReader(full.Bytes()),
+			bytes.NewReader(second.Bytes()))
+		if err != ErrCheckpointMismatch {
+			t.Errorf("Expected checkpoint mismatch, got %v", err)
+		}
+	})
+}
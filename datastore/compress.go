@@ -0,0 +1,262 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Compressed segments name their codec in the file header. Version 0 ones
+// start with four zero bytes and the codec instead; version 0 plain
+// segments start with the size of their first record, which is never zero,
+// so both kinds can live in one directory.
+const (
+	segmentHeaderSize     = 5
+	segmentCodecFlate     = 1
+	segmentBlockSize      = 4096
+	segmentBlockHeaderLen = 8
+)
+
+var ErrUnknownCodec = fmt.Errorf("unknown segment codec")
+
+// segmentBlock maps a range of the uncompressed record stream to its
+// compressed copy in the file. Records never span blocks, so index
+// offsets stay the same as in the plain segment.
+type segmentBlock struct {
+	rawOffset  int64
+	rawSize    int
+	fileOffset int64
+	fileSize   int
+}
+
+// compressSegment rewrites a plain segment file as flate compressed
+// blocks and returns the block table of the new file.
+func compressSegment(fs FS, path string) ([]segmentBlock, error) {
+	input, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	in := bufio.NewReader(input)
+	source, err := readFileHeader(in)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := path + ".tmp"
+	output, err := createFile(fs, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(output)
+
+	// The compressed file keeps the version of the plain one, as the
+	// version tells where its record stream starts.
+	header := fileHeader{version: source.version, codec: segmentCodecFlate}
+	if _, err := out.Write(header.encode()); err != nil {
+		output.Close()
+		return nil, err
+	}
+
+	var (
+		blocks     []segmentBlock
+		raw        bytes.Buffer
+		rawOffset  = header.dataStart()
+		fileOffset = header.size()
+	)
+	writeBlock := func() error {
+		var compressed bytes.Buffer
+		w, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(raw.Bytes()); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		blockHeader := make([]byte, segmentBlockHeaderLen)
+		binary.LittleEndian.PutUint32(blockHeader, uint32(raw.Len()))
+		binary.LittleEndian.PutUint32(blockHeader[4:], uint32(compressed.Len()))
+		if _, err := out.Write(blockHeader); err != nil {
+			return err
+		}
+		if _, err := out.Write(compressed.Bytes()); err != nil {
+			return err
+		}
+
+		blocks = append(blocks, segmentBlock{
+			rawOffset:  rawOffset,
+			rawSize:    raw.Len(),
+			fileOffset: fileOffset + segmentBlockHeaderLen,
+			fileSize:   compressed.Len(),
+		})
+		rawOffset += int64(raw.Len())
+		fileOffset += int64(segmentBlockHeaderLen + compressed.Len())
+		raw.Reset()
+		return nil
+	}
+
+	for {
+		record, err := readRecord(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			output.Close()
+			return nil, err
+		}
+		if raw.Len() > 0 && raw.Len()+len(record) > segmentBlockSize {
+			if err := writeBlock(); err != nil {
+				output.Close()
+				return nil, err
+			}
+		}
+		raw.Write(record)
+	}
+	if raw.Len() > 0 {
+		if err := writeBlock(); err != nil {
+			output.Close()
+			return nil, err
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		output.Close()
+		return nil, err
+	}
+	if err := closeSynced(output); err != nil {
+		return nil, err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// loadSegmentBlocks reads the block table of a compressed segment. It
+// returns nil for plain segments.
+func loadSegmentBlocks(fs FS, path string) ([]segmentBlock, error) {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	header, err := readFileHeader(in)
+	if err != nil {
+		return nil, err
+	}
+	if header.codec == 0 {
+		return nil, nil
+	}
+	if header.codec != segmentCodecFlate {
+		return nil, ErrUnknownCodec
+	}
+
+	var (
+		blocks     []segmentBlock
+		rawOffset  = header.dataStart()
+		fileOffset = header.size()
+	)
+	blockHeader := make([]byte, segmentBlockHeaderLen)
+	for {
+		_, err := io.ReadFull(in, blockHeader)
+		if err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		b := segmentBlock{
+			rawOffset:  rawOffset,
+			rawSize:    int(binary.LittleEndian.Uint32(blockHeader)),
+			fileOffset: fileOffset + segmentBlockHeaderLen,
+			fileSize:   int(binary.LittleEndian.Uint32(blockHeader[4:])),
+		}
+		if _, err := in.Discard(b.fileSize); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+		rawOffset += int64(b.rawSize)
+		fileOffset += int64(segmentBlockHeaderLen + b.fileSize)
+	}
+}
+
+func readBlock(file io.ReaderAt, b segmentBlock) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(io.NewSectionReader(file, b.fileOffset, int64(b.fileSize))))
+}
+
+// segmentReader reads records of a sealed segment by their offset in the
+// uncompressed record stream. The last inflated block is kept, as merges
+// and scans tend to hit the same block several times in a row.
+type segmentReader struct {
+	file   File
+	keys   *keyring
+	blocks []segmentBlock
+	cached int
+	data   []byte
+}
+
+func openSegmentReader(fs FS, seg *Segment, keys *keyring) (*segmentReader, error) {
+	f, err := openRead(fs, seg.outPath)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{file: f, keys: keys, blocks: seg.blocks, cached: -1}, nil
+}
+
+func (r *segmentReader) read(position int64) (entry, error) {
+	e, _, err := r.readSized(position)
+	return e, err
+}
+
+// readSized is read that also returns the size of the record.
+func (r *segmentReader) readSized(position int64) (entry, int, error) {
+	if r.blocks == nil {
+		return readSizedEntryAt(r.file, position, r.keys)
+	}
+
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.blocks[i].rawOffset+int64(r.blocks[i].rawSize) > position
+	})
+	if i == len(r.blocks) {
+		return entry{}, 0, io.ErrUnexpectedEOF
+	}
+	if i != r.cached {
+		data, err := readBlock(r.file, r.blocks[i])
+		if err != nil {
+			return entry{}, 0, err
+		}
+		r.cached, r.data = i, data
+	}
+
+	offset := position - r.blocks[i].rawOffset
+	return r.keys.readEntry(bufio.NewReader(bytes.NewReader(r.data[offset:])))
+}
+
+func (r *segmentReader) close() error {
+	return r.file.Close()
+}
+
+// SegmentStats describes one sealed segment.
+type SegmentStats struct {
+	Name     string
+	RawSize  int64
+	DiskSize int64
+}
+
+// Ratio returns how many times smaller the segment is on disk than its
+// records are.
+func (s SegmentStats) Ratio() float64 {
+	if s.DiskSize == 0 {
+		return 1
+	}
+	return float64(s.RawSize) / float64(s.DiskSize)
+}
@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 500, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(from, to int) {
+		for k := from; k < to; k++ {
+			err := db.Put(fmt.Sprintf("key%d", k), fmt.Sprintf("repeated value repeated value %d", k))
+			if err != nil {
+				t.Fatalf("Cannot put key%d: %s", k, err)
+			}
+		}
+	}
+
+	put(0, 20)
+	if len(db.segments) == 0 {
+		t.Fatal("Expected a plain segment")
+	}
+	db.compression = true
+	put(20, 60)
+
+	t.Run("mixed segments", func(t *testing.T) {
+		if db.segments[0].blocks != nil {
+			t.Errorf("First segment should stay plain")
+		}
+		if db.segments[len(db.segments)-1].blocks == nil {
+			t.Errorf("Last segment should be compressed")
+		}
+		for k := 0; k < 60; k++ {
+			value, err := db.Get(fmt.Sprintf("key%d", k))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", k, err)
+			}
+			if value != fmt.Sprintf("repeated value repeated value %d", k) {
+				t.Errorf("Bad value returned for key%d: %s", k, value)
+			}
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.mu.Lock()
+		err := db.mergeSegments()
+		db.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("key3")
+		if err != nil || value != "repeated value repeated value 3" {
+			t.Errorf("Bad value after merge %s (%v)", value, err)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := db.SegmentStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range stats {
+			if s.Ratio() <= 1 {
+				t.Errorf("Segment %s was not compressed: %d -> %d", s.Name, s.RawSize, s.DiskSize)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+const crashDir = "db"
+
+type crashRun struct {
+	acked   map[string]string
+	pending entry
+}
+
+// runCrashWorkload overwrites a few keys until a write fails, so that
+// segments roll over and merge, and returns what was acknowledged.
+func runCrashWorkload(fs FS, opts []Option) crashRun {
+	run := crashRun{acked: make(map[string]string)}
+	db, err := NewDb(currentFile, crashDir, 300, true, append(opts, WithFS(fs))...)
+	if err != nil {
+		return run
+	}
+	defer db.Close()
+	for i := 0; i < 150; i++ {
+		e := entry{key: fmt.Sprintf("key%d", i%12), value: fmt.Sprintf("value%d-%d", i, i*i)}
+		if err := db.Put(e.key, e.value); err != nil {
+			run.pending = e
+			return run
+		}
+		run.acked[e.key] = e.value
+	}
+	return run
+}
+
+func (run crashRun) check(t *testing.T, db *Db) {
+	t.Helper()
+	for key, value := range run.acked {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Acknowledged %s is lost: %s", key, err)
+		} else if got != value && (key != run.pending.key || got != run.pending.value) {
+			t.Errorf("Bad value returned for %s: expected %s, got %s", key, value, got)
+		}
+	}
+}
+
+func newCrashFS(t *testing.T) *MemFS {
+	fs := NewMemFS()
+	if err := fs.MkdirAll(crashDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestDb_Crash(t *testing.T) {
+	configs := []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"disk index", []Option{WithDiskIndex()}},
+		{"compression", []Option{WithCompression()}},
+		{"value log", []Option{WithValueLog(10)}},
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, c := range configs {
+		t.Run(c.name, func(t *testing.T) {
+			fault := NewFaultFS(newCrashFS(t))
+			if run := runCrashWorkload(fault, c.opts); run.pending.key != "" {
+				t.Fatalf("Write failed without faults: %s", run.pending.key)
+			}
+			total := fault.Ops()
+
+			for i := 0; i < 50; i++ {
+				at := 1 + rnd.Intn(total)
+				fs := newCrashFS(t)
+				fault := NewFaultFS(fs)
+				fault.Inject(at, Crash)
+				run := runCrashWorkload(fault, c.opts)
+				if !fault.Crashed() {
+					t.Fatalf("No crash at operation %d of %d", at, total)
+				}
+
+				db, err := NewDb(currentFile, crashDir, 300, true, append(c.opts, WithFS(fs))...)
+				if err != nil {
+					t.Fatalf("Cannot recover from a crash at operation %d: %s", at, err)
+				}
+				run.check(t, db)
+				if err := db.Put("after", "crash"); err != nil {
+					t.Errorf("Cannot write after a crash at operation %d: %s", at, err)
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if t.Failed() {
+					t.Fatalf("Crash at operation %d of %d", at, total)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_WriteFault(t *testing.T) {
+	fs := newCrashFS(t)
+	fault := NewFaultFS(fs)
+	db, err := NewDb(currentFile, crashDir, 1000, false, WithFS(fault))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []Fault{FailOp, TearWrite} {
+		fault.Inject(fault.Ops()+1, f)
+		if err := db.Put("broken", "value"); err == nil {
+			t.Errorf("Fault %d did not fail the write", f)
+		}
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(currentFile, crashDir, 1000, false, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	crashRun{acked: map[string]string{"key1": "value1", "key2": "value2"}}.check(t, db)
+	if _, err := db.Get("broken"); err != ErrNotFound {
+		t.Errorf("Expected the failed write to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypted records keep the usual size prefix, with encryptedRecordFlag
+// set, followed by the id of the key, a nonce and the sealed entry. The
+// flag lets plain and encrypted records live side by side, e.g. while an
+// existing database is being migrated by merges.
+const (
+	encryptedRecordFlag   = 0x80000000
+	encryptedHeaderSize   = 8
+	encryptionNonceSize   = 12
+	encryptionKeyIDLength = 4
+	encryptionOverhead    = encryptedHeaderSize + encryptionNonceSize + 16
+)
+
+var ErrEncrypted = fmt.Errorf("record is encrypted and no encryption key is configured")
+var ErrWrongKey = fmt.Errorf("record cannot be decrypted with the configured keys")
+var ErrEncryptedDiskIndex = fmt.Errorf("disk indexes hold plain keys and cannot be used with encryption")
+
+// keyring encrypts new records with the current key and decrypts records
+// written with any of the known keys. A nil keyring reads and writes
+// plain records.
+type keyring struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+func newKeyring(current []byte, old ...[]byte) (*keyring, error) {
+	k := &keyring{keys: make(map[uint32]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, old...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		k.keys[id] = aead
+		if i == 0 {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+func keyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.LittleEndian.Uint32(sum[:encryptionKeyIDLength])
+}
+
+// ReadKeyFile reads hex encoded AES keys, one per line. The first key is
+// used for new records, the rest only for reading older ones.
+func ReadKeyFile(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad key in %s: %s", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+	return keys, nil
+}
+
+// optionKeys builds the keyring configured by opts, for tools that read a
+// data directory without opening a Db.
+func optionKeys(opts []Option) (*keyring, error) {
+	db := &Db{}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if len(db.encryptionKeys) == 0 {
+		return nil, nil
+	}
+	return newKeyring(db.encryptionKeys[0], db.encryptionKeys[1:]...)
+}
+
+func isEncryptedRecord(data []byte) bool {
+	return binary.LittleEndian.Uint32(data)&encryptedRecordFlag != 0
+}
+
+func (k *keyring) encode(e entry) []byte {
+	plain := e.Encode()
+	if k == nil {
+		return plain
+	}
+
+	aead := k.keys[k.current]
+	size := encryptedHeaderSize + encryptionNonceSize + len(plain) + aead.Overhead()
+	res := make([]byte, encryptedHeaderSize+encryptionNonceSize, size)
+	binary.LittleEndian.PutUint32(res, uint32(size)|encryptedRecordFlag)
+	binary.LittleEndian.PutUint32(res[4:], k.current)
+	nonce := res[encryptedHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(res, nonce, plain, res[:encryptedHeaderSize])
+}
+
+func (k *keyring) decode(data []byte) (entry, error) {
+	var e entry
+	if !isEncryptedRecord(data) {
+		err := e.Decode(data)
+		return e, err
+	}
+	if k == nil {
+		return entry{}, ErrEncrypted
+	}
+	if len(data) < encryptedHeaderSize+encryptionNonceSize {
+		return entry{}, ErrWrongKey
+	}
+
+	aead, ok := k.keys[binary.LittleEndian.Uint32(data[4:])]
+	if !ok {
+		return entry{}, ErrWrongKey
+	}
+	nonce := data[encryptedHeaderSize : encryptedHeaderSize+encryptionNonceSize]
+	plain, err := aead.Open(nil, nonce, data[encryptedHeaderSize+encryptionNonceSize:], data[:encryptedHeaderSize])
+	if err != nil {
+		return entry{}, ErrWrongKey
+	}
+	err = e.Decode(plain)
+	return e, err
+}
+
+func (k *keyring) readEntry(in *bufio.Reader) (entry, int, error) {
+	data, err := readRecord(in)
+	if err != nil {
+		return entry{}, len(data), err
+	}
+	e, err := k.decode(data)
+	return e, len(data), err
+}
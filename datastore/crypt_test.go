@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	if _, err := NewDb(currentFile, dir, 500, false, WithEncryption(oldKey), WithDiskIndex()); err != ErrEncryptedDiskIndex {
+		t.Fatalf("Expected encryption with a disk index to fail, got %v", err)
+	}
+	db, err := NewDb(currentFile, dir, 500, false, WithEncryption(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k := 0; k < 30; k++ {
+		if err := db.Put(fmt.Sprintf("user%d", k), fmt.Sprintf("secret%d", k)); err != nil {
+			t.Fatalf("Cannot put user%d: %s", k, err)
+		}
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for k := 0; k < 30; k++ {
+			value, err := db.Get(fmt.Sprintf("user%d", k))
+			if err != nil {
+				t.Fatalf("Cannot get user%d: %s", k, err)
+			}
+			if value != fmt.Sprintf("secret%d", k) {
+				t.Errorf("Bad value returned for user%d: %s", k, value)
+			}
+		}
+	})
+
+	t.Run("no plaintext on disk", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("user")) {
+				t.Errorf("File %s contains plaintext", f)
+			}
+		}
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		db.keys, err = newKeyring(newKey, oldKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Lock()
+		err := db.mergeSegments()
+		db.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, seg := range db.segments {
+			data, err := ioutil.ReadFile(seg.outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := bufio.NewReader(bytes.NewReader(data))
+			if _, err := readFileHeader(in); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				record, err := readRecord(in)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if binary.LittleEndian.Uint32(record[4:]) != keyID(newKey) {
+					t.Fatalf("Segment %s has records with an old key", seg.outPath)
+				}
+			}
+		}
+		value, err := db.Get("user3")
+		if err != nil || value != "secret3" {
+			t.Errorf("Bad value after rotation %s (%v)", value, err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := NewDb(currentFile, dir, 500, false, WithEncryption(bytes.Repeat([]byte{3}, 32)))
+		if err != ErrWrongKey {
+			t.Errorf("Expected wrong key error, got %v", err)
+		}
+		_, err = NewDb(currentFile, dir, 500, false)
+		if err != ErrEncrypted {
+			t.Errorf("Expected encrypted error, got %v", err)
+		}
+	})
+
+	t.Run("repair without key", func(t *testing.T) {
+		if _, err := Repair(dir); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("Expected encrypted error, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, quarantineDir)); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be quarantined, got %v", err)
+		}
+		report, err := Check(dir, WithEncryption(newKey, oldKey))
+		if err != nil || !report.OK() {
+			t.Errorf("Expected the directory to check with the keys, got %v (%v)", report, err)
+		}
+	})
+}
@@ -2,7 +2,7 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -10,34 +10,42 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
 const currentFile = "current-data"
 const outFileName = "segment-"
+const mergeFileName = "merge-"
 
 var tempDir string
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 var ErrWrongDataType = fmt.Errorf("wrong data type")
+var ErrCorruptedValueLog = fmt.Errorf("corrupted value log record")
+var ErrClosed = fmt.Errorf("database is closed")
 
 type hashIndex map[string]int64
 
 type entryWithResp struct {
 	e        entry
+	batch    []entry
 	response chan error
+	queued   time.Time
 }
 
 type Segment struct {
-	out       *os.File
+	out       File
 	outPath   string
 	outOffset int64
-	index     hashIndex
+	index     segmentIndex
+	blocks    []segmentBlock
+	usage     fileUsage
 }
 
 type Db struct {
 	mu        sync.RWMutex
 	bufSize   int
-	out       *os.File
+	out       File
 	outPath   string
 	outOffset int64
 	segments  []Segment
@@ -45,42 +53,158 @@ type Db struct {
 	queue     chan entryWithResp
 	merge     chan bool
 	mergeable bool
+	diskIndex bool
+
+	fs             FS
+	dir            string
+	currentName    string
+	nextSegment    int
+	generation     int
+	vlog           *valueLog
+	valueThreshold int
+	compression    bool
+	keys           *keyring
+	encryptionKeys [][]byte
+	lock           *dirLock
+	watchers       watchers
+	secondary      map[string]*secondaryIndex
+	quota          quota
+	usage          usage
+	metrics        metrics
+
+	// lifecycle is held for reading while a write is handed to the writer
+	// goroutine, so that Close can stop the queue without a send racing it.
+	lifecycle  sync.RWMutex
+	closed     bool
+	writerDone chan bool
+	mergeDone  chan bool
 }
 
-func NewDb(filename, dir string, size int, mergeable bool) (*Db, error) {
-	outputPath := filepath.Join(dir, filename)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		log.Fatal(err)
+// Option changes the default behaviour of a Db created by NewDb.
+type Option func(db *Db)
+
+// WithDiskIndex keeps the key index of sealed segments on disk, next to
+// the segment files, with only a sparse sample of keys held in memory.
+// Memory use then grows with the number of segments instead of keys.
+// The index files are not encrypted, so it cannot go with WithEncryption.
+func WithDiskIndex() Option {
+	return func(db *Db) {
+		db.diskIndex = true
 	}
+}
+
+// WithCompression stores sealed and merged segments as flate compressed
+// blocks. Segments written without it stay readable.
+func WithCompression() Option {
+	return func(db *Db) {
+		db.compression = true
+	}
+}
 
+// WithEncryption encrypts every record written from now on with AES-GCM
+// using key, which must be 16, 24 or 32 bytes long. Records written with
+// any of the old keys stay readable and are re-encrypted with the new key
+// when segments are merged.
+func WithEncryption(key []byte, oldKeys ...[]byte) Option {
+	return func(db *Db) {
+		db.encryptionKeys = append([][]byte{key}, oldKeys...)
+	}
+}
+
+// WithValueLog moves values longer than threshold bytes into a separate
+// value log, leaving only small pointers in the segments. Merging then
+// copies pointers instead of whole values; use CollectValueLog to reclaim
+// space taken by overwritten values.
+func WithValueLog(threshold int) Option {
+	return func(db *Db) {
+		db.valueThreshold = threshold
+	}
+}
+
+func NewDb(filename, dir string, size int, mergeable bool, opts ...Option) (*Db, error) {
+	outputPath := filepath.Join(dir, filename)
 	db := &Db{
 		outPath:   outputPath,
-		out:       f,
 		outOffset: 0,
 		index:     make(hashIndex),
 		queue:     make(chan entryWithResp),
 		bufSize:   size,
 		merge:     make(chan bool),
 		mergeable: mergeable,
+		dir:       dir,
+
+		currentName: filename,
+		writerDone:  make(chan bool),
+		mergeDone:   make(chan bool),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	db.fs = orOSFS(db.fs)
+	if db.diskIndex && len(db.encryptionKeys) > 0 {
+		return nil, ErrEncryptedDiskIndex
+	}
+
+	lock, err := lockDir(db.fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	db.lock = lock
+	fail := func(err error) (*Db, error) {
+		if db.out != nil {
+			db.out.Close()
+		}
+		if db.vlog != nil {
+			db.vlog.close()
+		}
+		lock.unlock()
+		return nil, err
+	}
+	if db.out, _, err = openDataFile(db.fs, outputPath); err != nil {
+		return fail(err)
+	}
+	if len(db.encryptionKeys) > 0 {
+		db.keys, err = newKeyring(db.encryptionKeys[0], db.encryptionKeys[1:]...)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if db.valueThreshold > 0 {
+		db.vlog, err = openValueLog(db.fs, dir, int64(size), db.keys)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := db.loadSegments(); err != nil {
+		return fail(err)
 	}
 	err = db.recover()
 	if err != nil && err != io.EOF {
-		return nil, err
+		return fail(err)
+	}
+	if err := db.rebuild(); err != nil {
+		return fail(err)
 	}
 
 	go func() {
 
 		for el := range db.queue {
 			db.mu.Lock()
-			err := db.putIntoDataBase(el.e)
-			db.mu.Unlock()
-			if err != nil {
-				el.response <- err
+			db.metrics.observe(&db.metrics.queueWait, el.queued)
+			var err error
+			if el.batch != nil {
+				for _, e := range el.batch {
+					if err = db.putIntoDataBase(e); err != nil {
+						break
+					}
+				}
+			} else {
+				err = db.putIntoDataBase(el.e)
 			}
-
-			el.response <- nil
+			db.mu.Unlock()
+			el.response <- err
 		}
+		close(db.writerDone)
 	}()
 
 	go func() {
@@ -93,169 +217,562 @@ func NewDb(filename, dir string, size int, mergeable bool) (*Db, error) {
 				}
 			}
 		}
+		close(db.mergeDone)
 	}()
 
 	return db, nil
 }
 
+// mergeSegments rewrites all sealed segments keeping only the latest
+// record of every key. Segment indexes are walked in key order, newest
+// segment first, so the merge never holds the whole key set in memory.
 func (db *Db) mergeSegments() error {
-
-	var segmentsMerged []Segment
-
-	mergedSegment, err := createNewSegment(nil, outFileName+strconv.Itoa(len(db.segments)+1), 0, make(hashIndex))
-	segmentLength := len(db.segments)
-	mergedSegment.outOffset = 0
-	if err != nil {
-		return err
+	started := time.Now()
+	var sources []indexIterator
+	readers := make([]*segmentReader, 0, len(db.segments))
+	defer func() {
+		for _, r := range readers {
+			r.close()
+		}
+	}()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		reader, err := openSegmentReader(db.fs, &db.segments[i], db.keys)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, reader)
+		it, err := db.segments[i].index.iterator("")
+		if err != nil {
+			return err
+		}
+		sources = append(sources, it)
 	}
-	for _, el := range db.segments {
-		for key := range el.index {
-			segIndex, position, ok := db.getLastFromSegments(key)
-			if segIndex != nil && ok {
-				file, err := os.Open(db.segments[*segIndex].outPath)
-				if err != nil {
-					return err
-				}
-				_, err = file.Seek(position, 0)
-				if err != nil {
-					return err
-				}
 
-				reader := bufio.NewReader(file)
-				value, _, err := readValue(reader)
-				if err != nil {
-					return err
-				}
-				e := entry{
-					key:   key,
-					value: value,
-				}
-				encoded := e.Encode()
-				if int(mergedSegment.outOffset)+len(encoded) > db.bufSize {
-					mergedSegment.out.Close()
-					segmentLength++
-					segmentsMerged = append(segmentsMerged, *mergedSegment)
-					mergedSegment, err = createNewSegment(nil, outFileName+strconv.Itoa(segmentLength+1), 0, make(hashIndex))
-					if err != nil {
-						return err
-					}
+	var (
+		merged  []*Segment
+		current *Segment
+		index   hashIndex
+	)
+	for {
+		winner := -1
+		for i, s := range sources {
+			if s.valid() && (winner == -1 || s.current().key < sources[winner].current().key) {
+				winner = i
+			}
+		}
+		if winner == -1 {
+			break
+		}
+		k := sources[winner].current()
+		for _, s := range sources {
+			if s.valid() && s.current().key == k.key {
+				s.next()
+			}
+		}
 
+		e, err := readers[winner].read(k.offset)
+		if err != nil {
+			return err
+		}
+		// All sealed segments take part, so nothing older than a
+		// tombstone survives the merge and it can go as well.
+		if e.valueType == tombstoneType {
+			continue
+		}
+		encoded := db.keys.encode(e)
+		if current == nil || int(current.outOffset)+len(encoded) > db.bufSize {
+			if current != nil {
+				if err := closeSynced(current.out); err != nil {
+					return err
 				}
-				n, err := mergedSegment.out.Write(e.Encode())
-				if err == nil {
-					mergedSegment.index[key] = mergedSegment.outOffset
-					mergedSegment.outOffset += int64(n)
-				}
-				file.Close()
+				merged = append(merged, current)
 			}
-			for i := 0; i <= *segIndex; i++ {
-				_, ok := db.segments[i].index[key]
-				if ok {
-					delete(db.segments[i].index, key)
-				}
+			index = make(hashIndex)
+			path := filepath.Join(db.dir, mergeFileName+strconv.Itoa(len(merged)+1))
+			if err := db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			f, size, err := openDataFile(db.fs, path)
+			if err != nil {
+				return err
+			}
+			current, err = createNewSegment(f, path, int(size), index)
+			if err != nil {
+				return err
 			}
 		}
-		if len(el.index) == 0 {
-			os.Remove(el.outPath)
+		n, err := current.out.Write(encoded)
+		if err != nil {
+			return err
 		}
+		index[k.key] = current.outOffset
+		current.usage.keys++
+		current.usage.live += int64(n)
+		current.outOffset += int64(n)
 	}
-	mergedSegment.out.Close()
-	db.segments = append(segmentsMerged, *mergedSegment)
+	for _, s := range sources {
+		if err := s.err(); err != nil {
+			return err
+		}
+	}
+	if current != nil {
+		if err := closeSynced(current.out); err != nil {
+			return err
+		}
+		merged = append(merged, current)
+	}
+
+	// The merged segments are synced, named and listed in the manifest
+	// before the old ones are removed, so a crash at any point leaves every
+	// record in a segment that loadSegments finds.
+	var segments []Segment
+	for _, el := range merged {
+		path := db.newSegmentPath()
+		if err := db.fs.Rename(el.outPath, path); err != nil {
+			return err
+		}
+		el.outPath = path
+		if err := db.sealSegment(el, el.index.(hashIndex)); err != nil {
+			return err
+		}
+		segments = append(segments, *el)
+	}
+	old := db.segments
+	db.segments = segments
+	if err := db.saveManifest(); err != nil {
+		db.segments = old
+		return err
+	}
+	var reclaimed int64
+	for _, el := range old {
+		reclaimed += el.outOffset
+	}
+	for _, el := range segments {
+		reclaimed -= el.outOffset
+	}
+	db.metrics.merged(started, reclaimed)
+
+	for _, el := range old {
+		el.index.close()
+		db.fs.Remove(el.outPath)
+		if db.diskIndex {
+			db.fs.Remove(el.outPath + indexFileSuffix)
+		}
+	}
+	return nil
+}
+
+func (db *Db) segmentPath(n int) string {
+	return filepath.Join(db.dir, outFileName+strconv.Itoa(n))
+}
+
+// newSegmentPath returns the path for the next sealed segment. Numbers
+// are never reused, so a segment name always refers to the same data.
+func (db *Db) newSegmentPath() string {
+	db.nextSegment++
+	return db.segmentPath(db.nextSegment)
+}
 
-	for i, el := range db.segments {
-		err := os.Rename(el.outPath, tempDir+`\`+outFileName+strconv.Itoa(i+1))
+// sealSegment prepares a segment that no longer changes for reading. It
+// compresses the file and moves the index to disk if the Db is set up so.
+func (db *Db) sealSegment(seg *Segment, index hashIndex) error {
+	if db.compression {
+		blocks, err := compressSegment(db.fs, seg.outPath)
 		if err != nil {
 			return err
 		}
-		db.segments[i].outPath = tempDir + `\` + outFileName + strconv.Itoa(i+1)
+		seg.blocks = blocks
 	}
+	return db.sealIndex(seg, index)
+}
 
+// sealIndex sets the index of a sealed segment, writing it to disk first
+// if the Db keeps indexes there.
+func (db *Db) sealIndex(seg *Segment, index hashIndex) error {
+	if !db.diskIndex {
+		seg.index = sortedIndex(index.sorted(""))
+		return nil
+	}
+	idx, err := writeDiskIndex(db.fs, seg.outPath+indexFileSuffix, index)
+	if err != nil {
+		return err
+	}
+	seg.index = idx
 	return nil
 }
 
-func (db *Db) getLastFromSegments(key string) (*int, int64, bool) {
-	var currentSegment *int
-	i := len(db.segments) - 1
-	for i >= 0 {
-		currentSegment = &i
-		position, ok := db.segments[i].index[key]
+func (db *Db) getLastFromSegments(key string) (int, int64, bool, error) {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		position, ok, err := db.segments[i].index.get(key)
+		if err != nil {
+			return 0, 0, false, err
+		}
 		if ok {
-			return currentSegment, position, ok
-
-		} else {
-			i--
+			return i, position, true, nil
 		}
 	}
-	return nil, 0, false
+	return 0, 0, false, nil
+}
+
+func readEntryAt(file io.ReadSeeker, position int64, keys *keyring) (entry, error) {
+	e, _, err := readSizedEntryAt(file, position, keys)
+	return e, err
+}
+
+// readSizedEntryAt is readEntryAt that also returns the size of the record.
+func readSizedEntryAt(file io.ReadSeeker, position int64, keys *keyring) (entry, int, error) {
+	_, err := file.Seek(position, 0)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	return keys.readEntry(bufio.NewReader(file))
 }
 
+// recover rebuilds the index of the current file. A record cut short at
+// the end of the file is what a crash during a write leaves; it was never
+// acknowledged, so it is dropped to let new records follow the last
+// complete one.
 func (db *Db) recover() error {
-	input, err := os.Open(db.outPath)
+	input, err := openRead(db.fs, db.outPath)
 	if err != nil {
 		return err
 	}
 	defer input.Close()
 
-	buf := make([]byte, 0, db.bufSize)
 	in := bufio.NewReaderSize(input, db.bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(db.bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
+	h, err := readFileHeader(in)
+	if err != nil {
+		return err
+	}
+	db.outOffset = h.size()
+	for {
+		e, n, err := db.keys.readEntry(in)
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Dropping incomplete record at %d of %s", db.outOffset, db.outPath)
+			return db.out.Truncate(db.outOffset)
 		} else if err != nil {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
+		db.index[e.key] = db.outOffset
+		db.usage.record(e, n)
+		db.outOffset += int64(n)
+	}
+}
+
+// rebuild counts every key into the secondary indexes and the quota
+// usage, which are only kept in memory, before the Db is shared.
+func (db *Db) rebuild() error {
+	if len(db.secondary) == 0 && !db.quota.tracking() {
+		return nil
+	}
+	return db.forEach("", "", func(e entry) error {
+		db.updateIndexes(e)
+		db.quota.add(e)
+		return nil
+	})
+}
+
+// Close stops accepting writes, lets the writer finish the ones already
+// queued together with a merge they started, syncs the files and releases
+// the directory. Calls after the first one do nothing.
+func (db *Db) Close() error {
+	db.lifecycle.Lock()
+	if db.closed {
+		db.lifecycle.Unlock()
+		return nil
+	}
+	db.mu.Lock()
+	db.closed = true
+	db.mu.Unlock()
+	close(db.queue)
+	db.lifecycle.Unlock()
+
+	<-db.writerDone
+	close(db.merge)
+	<-db.mergeDone
+	db.watchers.close()
 
-		if int(size) < db.bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var errs []error
+	if db.vlog != nil {
+		errs = append(errs, db.vlog.close())
+	}
+	errs = append(errs, db.out.Sync(), db.out.Close())
+	for _, seg := range db.segments {
+		errs = append(errs, seg.index.close())
+	}
+	errs = append(errs, db.lock.unlock())
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
-		n, err = in.Read(data)
+	}
+	return nil
+}
+
+// send hands a write to the writer goroutine and waits for its result.
+// The response channel must be buffered, so that the writer never waits
+// for a caller that gave up.
+func (db *Db) send(ctx context.Context, i entryWithResp) error {
+	i.queued = time.Now()
+	db.lifecycle.RLock()
+	if db.closed {
+		db.lifecycle.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case db.queue <- i:
+	case <-ctx.Done():
+		db.lifecycle.RUnlock()
+		return ctx.Err()
+	}
+	db.lifecycle.RUnlock()
+
+	select {
+	case err := <-i.response:
+		db.metrics.observe(&db.metrics.puts, i.queued)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Db) get(key string) (string, string, error) {
+	value, typeOfValue, err := db.getRaw(key)
+	if err == nil && typeOfValue == tombstoneType {
+		return "", "", ErrNotFound
+	}
+	if err != nil || !isValuePointer(typeOfValue) {
+		return value, typeOfValue, err
+	}
+
+	e, err := db.resolve(entry{key: key, valueType: typeOfValue, value: value})
+	if err != nil {
+		return "", "", err
+	}
+	return e.value, e.valueType, nil
+}
+
+// resolve follows a value log pointer, returning other entries as is.
+func (db *Db) resolve(e entry) (entry, error) {
+	if !isValuePointer(e.valueType) {
+		return e, nil
+	}
+	if db.vlog == nil {
+		return entry{}, ErrCorruptedValueLog
+	}
+	p, err := decodeValuePointer(e.value)
+	if err != nil {
+		return entry{}, err
+	}
+	return db.vlog.read(p)
+}
+
+// forEach calls fn with the latest record of every key in [start, end)
+// in ascending key order; an empty end means no upper bound. The caller
+// must hold the read lock.
+func (db *Db) forEach(start, end string, fn func(e entry) error) error {
+	v, err := db.view(start, false)
+	if err != nil {
+		return err
+	}
+	defer v.close()
+	return v.forEach(end, fn)
+}
+
+// walk is forEach for the records as they are stored, tombstones and
+// value log pointers included, passing the path of the file holding each
+// one and its size there. The caller must hold the read lock.
+func (db *Db) walk(start, end string, fn func(path string, e entry, size int) error) error {
+	v, err := db.view(start, false)
+	if err != nil {
+		return err
+	}
+	defer v.close()
+	return v.walk(end, fn)
+}
+
+// readView holds the records of a Db with keys from some start on as they
+// were when it was taken: open data files and copies of the indexes.
+type readView struct {
+	sources []indexIterator
+	paths   []string
+	readers []func(position int64) (entry, int, error)
+	values  func(p valuePointer) (entry, error)
+	closers []func() error
+}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+// view opens the files of the records with keys from start on. The caller
+// must hold the read lock while the view is taken. A detached view also
+// opens the index and value log files, so it can be read after the lock
+// is released: open files stay readable when a merge or value log
+// collection removes them.
+func (db *Db) view(start string, detached bool) (*readView, error) {
+	v := &readView{}
+	fail := func(err error) (*readView, error) {
+		v.close()
+		return nil, err
+	}
+
+	current, err := openRead(db.fs, db.outPath)
+	if err != nil {
+		return nil, err
+	}
+	v.closers = append(v.closers, current.Close)
+	keys := db.keys
+	currentIt, _ := db.index.iterator(start)
+	v.sources = append(v.sources, currentIt)
+	v.paths = append(v.paths, db.outPath)
+	v.readers = append(v.readers, func(position int64) (entry, int, error) {
+		return readSizedEntryAt(current, position, keys)
+	})
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		reader, err := openSegmentReader(db.fs, &db.segments[i], keys)
+		if err != nil {
+			return fail(err)
+		}
+		v.closers = append(v.closers, reader.close)
+		index := db.segments[i].index
+		if idx, ok := index.(*diskIndex); ok && detached {
+			if index, err = idx.reopen(db.fs); err != nil {
+				return fail(err)
 			}
+			v.closers = append(v.closers, index.close)
+		}
+		it, err := index.iterator(start)
+		if err != nil {
+			return fail(err)
+		}
+		v.sources = append(v.sources, it)
+		v.paths = append(v.paths, db.segments[i].outPath)
+		v.readers = append(v.readers, reader.readSized)
+	}
 
-			var e entry
-			e.Decode(data)
-			db.index[e.key] = db.outOffset
-			db.outOffset += int64(n)
+	switch {
+	case db.vlog == nil:
+		v.values = func(valuePointer) (entry, error) {
+			return entry{}, ErrCorruptedValueLog
 		}
+	case detached:
+		files := make(map[int]File)
+		v.closers = append(v.closers, func() error {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil
+		})
+		for _, id := range db.vlog.files {
+			f, err := openRead(db.fs, db.vlog.path(id))
+			if err != nil {
+				return fail(err)
+			}
+			files[id] = f
+		}
+		v.values = func(p valuePointer) (entry, error) {
+			f, ok := files[p.file]
+			if !ok {
+				return entry{}, ErrCorruptedValueLog
+			}
+			return readValueAt(f, p, keys)
+		}
+	default:
+		v.values = db.vlog.read
 	}
-	return err
+	return v, nil
 }
 
-func (db *Db) Close() error {
-	return db.out.Close()
+func (v *readView) close() {
+	for _, c := range v.closers {
+		c()
+	}
+	v.closers = nil
 }
 
-func (db *Db) get(key string) (string, string, error) {
-	var currentSegment *int
-	var file *os.File
-	var err error
+// forEach is Db.forEach on the records of the view.
+func (v *readView) forEach(end string, fn func(e entry) error) error {
+	return v.walk(end, func(_ string, e entry, _ int) error {
+		if e.valueType == tombstoneType {
+			return nil
+		}
+		if isValuePointer(e.valueType) {
+			p, err := decodeValuePointer(e.value)
+			if err != nil {
+				return err
+			}
+			if e, err = v.values(p); err != nil {
+				return err
+			}
+		}
+		return fn(e)
+	})
+}
+
+// walk is Db.walk on the records of the view.
+func (v *readView) walk(end string, fn func(path string, e entry, size int) error) error {
+	for {
+		winner := -1
+		for i, s := range v.sources {
+			if s.valid() && (winner == -1 || s.current().key < v.sources[winner].current().key) {
+				winner = i
+			}
+		}
+		if winner == -1 {
+			break
+		}
+		k := v.sources[winner].current()
+		for _, s := range v.sources {
+			if s.valid() && s.current().key == k.key {
+				s.next()
+			}
+		}
+		if end != "" && k.key >= end {
+			break
+		}
 
+		e, size, err := v.readers[winner](k.offset)
+		if err != nil {
+			return err
+		}
+		if err := fn(v.paths[winner], e, size); err != nil {
+			return err
+		}
+	}
+	for _, s := range v.sources {
+		if err := s.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRaw returns the record stored in the segments, without following
+// value log pointers.
+func (db *Db) getRaw(key string) (string, string, error) {
 	position, ok := db.index[key]
 	if !ok {
-		currentSegment, position, ok = db.getLastFromSegments(key)
+		segment, position, ok, err := db.getLastFromSegments(key)
+		if err != nil {
+			return "", "", err
+		}
 		if !ok {
 			return "", " ", ErrNotFound
 		}
-	}
 
-	if currentSegment != nil {
-		file, err = os.Open(db.segments[*currentSegment].outPath)
-	} else {
-		file, err = os.Open(db.outPath)
+		reader, err := openSegmentReader(db.fs, &db.segments[segment], db.keys)
+		if err != nil {
+			return "", "", err
+		}
+		defer reader.close()
+		e, err := reader.read(position)
+		if err != nil {
+			return "", "", err
+		}
+		return e.value, e.valueType, nil
 	}
+
+	file, err := openRead(db.fs, db.outPath)
 	if err != nil {
 		return "", "", err
 	}
@@ -267,69 +784,188 @@ func (db *Db) get(key string) (string, string, error) {
 	}
 
 	reader := bufio.NewReader(file)
-	value, typeOfValue, err := readValue(reader)
+	e, _, err := db.keys.readEntry(reader)
 	if err != nil {
 		return "", "", err
 	}
 
-	return value, typeOfValue, nil
+	return e.value, e.valueType, nil
 }
 
 func (db *Db) putIntoDataBase(e entry) error {
-	encoded := e.Encode()
+	if err := checkSize(e); err != nil {
+		return err
+	}
+	if err := db.quota.check(e); err != nil {
+		return err
+	}
+	offset, err := db.appendEntry(e)
+	if err != nil {
+		return err
+	}
+	db.updateIndexes(e)
+	db.quota.add(e)
+	db.watchers.publish(newChange(e, db.sequence(offset)))
+	return nil
+}
+
+// appendEntry writes e to the current file, moving a long value to the
+// value log, and returns the offset of the record. Unlike putIntoDataBase
+// it does not count as a change of the key, for writes that only move a
+// value like value log collection.
+func (db *Db) appendEntry(e entry) (int64, error) {
+	if db.vlog != nil && len(e.value) > db.valueThreshold && !isValuePointer(e.valueType) {
+		p, err := db.vlog.append(e)
+		if err != nil {
+			return 0, err
+		}
+		e = entry{
+			key:       e.key,
+			valueType: valuePointerType + e.valueType,
+			value:     p.encode(),
+		}
+	}
+	encoded := db.keys.encode(e)
 
 	if int(db.outOffset)+len(encoded) > db.bufSize {
-		db.Close()
-		err := os.Rename(db.outPath, tempDir+`\`+outFileName+strconv.Itoa(len(db.segments)+1))
+		db.out.Close()
+		path := db.newSegmentPath()
+		err := db.fs.Rename(db.outPath, path)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		db.outPath = tempDir + `\` + outFileName + strconv.Itoa(len(db.segments)+1)
+		db.outPath = path
 		newSeg, err := createNewSegment(db.out, db.outPath, int(db.outOffset), db.index)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		newSeg.out.Close()
+		newSeg.usage = db.usage.total()
+		if err := db.sealSegment(newSeg, db.index); err != nil {
+			return 0, err
+		}
 
 		db.segments = append(db.segments, *newSeg)
+		db.generation++
+		if err := db.saveManifest(); err != nil {
+			return 0, err
+		}
 
-		outputPath := filepath.Join(tempDir, currentFile)
-		f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-
-		db.out = f
-		db.outOffset = 0
+		outputPath := filepath.Join(db.dir, db.currentName)
 		db.index = make(hashIndex)
+		db.usage = usage{}
 		db.outPath = outputPath
+		f, size, err := openDataFile(db.fs, outputPath)
+		if err != nil {
+			// db.out stays the closed old file, so later writes fail too.
+			return 0, err
+		}
+		db.out = f
+		db.outOffset = size
 
 		if len(db.segments) >= 2 && db.mergeable {
 			db.merge <- true
 
 			db.merge <- false
 		}
-		if err != nil {
-			return err
-		}
 	}
 
-	n, err := db.out.Write(e.Encode())
-	if err == nil {
-		db.index[e.key] = db.outOffset
-		db.outOffset += int64(n)
+	n, err := db.out.Write(encoded)
+	if err != nil {
+		// A partly written record would shift every later one away from
+		// the offset the index keeps for it.
+		db.out.Truncate(db.outOffset)
+		return 0, err
+	}
+	offset := db.outOffset
+	db.usage.record(e, n)
+	db.index[e.key] = offset
+	db.outOffset += int64(n)
+	return offset, nil
+}
+
+// CollectValueLog rewrites the values of the oldest value log file that
+// are still referenced by their keys and removes the file. The rewrites
+// leave the values as they are, so watchers are not told about them and
+// replays skip them.
+func (db *Db) CollectValueLog() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.vlog == nil || len(db.vlog.files) < 2 {
 		return nil
 	}
 
-	return err
+	id := db.vlog.files[0]
+	input, err := openRead(db.fs, db.vlog.path(id))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	in := bufio.NewReader(input)
+	h, err := readFileHeader(in)
+	if err != nil {
+		return err
+	}
+	offset := h.size()
+	for {
+		e, n, err := db.keys.readEntry(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		value, typeOfValue, err := db.getRaw(e.key)
+		if err == nil && isValuePointer(typeOfValue) {
+			p, err := decodeValuePointer(value)
+			if err == nil && p.file == id && p.offset == offset {
+				if p, err = db.vlog.append(e); err != nil {
+					return err
+				}
+				moved := entry{key: e.key, valueType: movedPointerType + e.valueType, value: p.encode()}
+				if _, err := db.appendEntry(moved); err != nil {
+					return err
+				}
+			}
+		} else if err != nil && err != ErrNotFound {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	db.vlog.files = db.vlog.files[1:]
+	return db.fs.Remove(db.vlog.path(id))
 }
 
-func createNewSegment(outF *os.File, outPath string, outOffset int, index hashIndex) (*Segment, error) {
-	if outF == nil {
-		outPath = filepath.Join(tempDir, outPath)
-		f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+// SegmentStats reports the size of every sealed segment before and after
+// compression.
+func (db *Db) SegmentStats() ([]SegmentStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	res := make([]SegmentStats, 0, len(db.segments))
+	for _, seg := range db.segments {
+		info, err := db.fs.Stat(seg.outPath)
 		if err != nil {
 			return nil, err
 		}
-		outF = f
+		res = append(res, SegmentStats{
+			Name:     filepath.Base(seg.outPath),
+			RawSize:  seg.outOffset,
+			DiskSize: info.Size(),
+		})
 	}
+	return res, nil
+}
+
+func createNewSegment(outF File, outPath string, outOffset int, index segmentIndex) (*Segment, error) {
 	newSeg := &Segment{
 		out:       outF,
 		outPath:   outPath,
@@ -341,9 +977,25 @@ func createNewSegment(outF *os.File, outPath string, outOffset int, index hashIn
 }
 
 func (db *Db) Get(key string) (string, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	stringValue, typeOfValue, err := db.get(key)
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *Db) GetInt64(key string) (int64, error) {
+	return db.GetInt64Context(context.Background(), key)
+}
+
+func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.PutInt64Context(context.Background(), key, value)
+}
+
+// GetContext is Get that gives up with the context error if ctx is done
+// before the read can start, e.g. while a merge holds the database.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	stringValue, typeOfValue, err := db.getContext(ctx, key)
 	if err != nil {
 		return "", err
 	}
@@ -351,17 +1003,13 @@ func (db *Db) Get(key string) (string, error) {
 		return "", ErrWrongDataType
 	}
 	return stringValue, nil
-
 }
-func (db *Db) GetInt64(key string) (int64, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	stringValue, typeOfValue, err := db.get(key)
 
+func (db *Db) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	stringValue, typeOfValue, err := db.getContext(ctx, key)
 	if err != nil {
 		return 0, err
 	}
-
 	if typeOfValue != "i" {
 		return 0, ErrWrongDataType
 	}
@@ -374,33 +1022,96 @@ func (db *Db) GetInt64(key string) (int64, error) {
 	return value, nil
 }
 
-func (db *Db) Put(key, value string) error {
-	en := entry{
+// PutContext is Put that stops waiting with the context error if ctx is
+// done first. A write the writer has already taken may still be applied.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	return db.write(ctx, entry{
 		key:       key,
 		valueType: "s",
 		value:     value,
-	}
+	})
+}
 
-	i := entryWithResp{
-		e:        en,
-		response: make(chan error),
+func (db *Db) PutInt64Context(ctx context.Context, key string, value int64) error {
+	if reservedKey(key) {
+		return ErrReservedKey
 	}
-
-	db.queue <- i
-	return <-i.response
-}
-func (db *Db) PutInt64(key string, value int64) error {
-	en := entry{
+	return db.write(ctx, entry{
 		key:       key,
 		valueType: "i",
 		value:     strconv.FormatInt(value, 10),
+	})
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	return db.write(ctx, entry{key: key, valueType: tombstoneType})
+}
+
+// write hands a single record to the writer goroutine.
+func (db *Db) write(ctx context.Context, e entry) error {
+	return db.send(ctx, entryWithResp{e: e, response: make(chan error, 1)})
+}
+
+// Scan calls fn for every key in [start, end) in ascending order. An empty
+// end means no upper bound. Scanning stops at the first error returned by fn.
+func (db *Db) Scan(start, end string, fn func(key, value string) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.forEach(start, end, func(e entry) error {
+		return fn(e.key, e.value)
+	})
+}
+
+func (db *Db) getContext(ctx context.Context, key string) (string, string, error) {
+	defer db.metrics.observe(&db.metrics.gets, time.Now())
+	if err := db.readLock(ctx); err != nil {
+		return "", "", err
+	}
+	defer db.mu.RUnlock()
+	if db.closed {
+		return "", "", ErrClosed
 	}
+	return db.get(key)
+}
 
-	i := entryWithResp{
-		e:        en,
-		response: make(chan error),
+// readLock takes the read lock unless ctx is done first. A lock obtained
+// too late is released right away.
+func (db *Db) readLock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		db.mu.RLock()
+		return nil
 	}
 
-	db.queue <- i
-	return <-i.response
+	locked := make(chan bool)
+	go func() {
+		db.mu.RLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			db.mu.RUnlock()
+		}()
+		return ctx.Err()
+	}
 }
@@ -1,11 +1,15 @@
 package datastore
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -69,7 +73,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if size1*2 != outInfo.Size() {
+		if (size1-fileHeaderSize)*2 != outInfo.Size()-fileHeaderSize {
 			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
 		}
 	})
@@ -276,3 +280,127 @@ func TestDb_PutGetInt64(t *testing.T) {
 
 	})
 }
+
+func TestDb_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 200, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers racing Close either get their value stored or ErrClosed.
+	stored := make(chan string, 100)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := 0; k < 25; k++ {
+				key := fmt.Sprintf("key%d-%d", w, k)
+				err := db.Put(key, "value")
+				if err == ErrClosed {
+					return
+				} else if err != nil {
+					t.Errorf("Cannot put %s: %s", key, err)
+					return
+				}
+				stored <- key
+			}
+		}(w)
+	}
+	time.Sleep(time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(stored)
+
+	t.Run("closed", func(t *testing.T) {
+		if err := db.Put("key", "value"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Put, got %v", err)
+		}
+		if _, err := db.Get("key0-0"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Get, got %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Errorf("Second Close failed: %s", err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := NewDb(currentFile, dir, 200, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key := range stored {
+			if _, err := db.Get(key); err != nil {
+				t.Errorf("Acknowledged %s is lost: %s", key, err)
+			}
+		}
+	})
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 200, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.PutContext(ctx, "key", "other"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from PutContext, got %v", err)
+		}
+		if _, err := db.GetContext(ctx, "key"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from GetContext, got %v", err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		// Holding the lock stalls the writer as a long merge would.
+		db.mu.Lock()
+		stalled := make(chan error, 1)
+		go func() {
+			stalled <- db.Put("stalled", "value")
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "key", "late"); err != context.DeadlineExceeded {
+			t.Errorf("Expected context.DeadlineExceeded from PutContext, got %v", err)
+		}
+		if _, err := db.GetContext(ctx, "key"); err != context.DeadlineExceeded {
+			t.Errorf("Expected context.DeadlineExceeded from GetContext, got %v", err)
+		}
+		db.mu.Unlock()
+
+		if err := <-stalled; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutContext(context.Background(), "key", "next"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.GetContext(context.Background(), "key"); err != nil || value != "next" {
+			t.Errorf("Expected next, got %q (%v)", value, err)
+		}
+	})
+}
@@ -2,10 +2,37 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
+// entryHeaderSize is the size of a record with empty key, type and value:
+// the record size and the three field lengths.
+const (
+	entryHeaderSize = 16
+	maxTypeSize     = 255
+
+	recordPreallocSize = 1 << 20
+)
+
+var ErrCorruptedRecord = fmt.Errorf("corrupted record")
+var ErrTooLarge = fmt.Errorf("key or value exceeds the size limit")
+
+// MaxKeySize and MaxValueSize limit the records written and read. Length
+// fields beyond them mean a damaged record rather than a reason to
+// allocate that much memory, so they must not be lowered below the sizes
+// already stored.
+var (
+	MaxKeySize   = 64 << 10
+	MaxValueSize = 64 << 20
+)
+
+// tombstoneType marks a deleted key. Merges and compactions drop the
+// record once no older value of the key is left behind it.
+const tombstoneType = "d"
+
 type entry struct {
 	key, valueType, value string
 }
@@ -26,71 +53,100 @@ func (e *entry) Encode() []byte {
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
-
-	tl := binary.LittleEndian.Uint32(input[kl+8:])
-	typeBuf := make([]byte, tl)
-	copy(typeBuf, input[kl+12:kl+12+tl])
-	e.valueType = string(typeBuf)
-
-	vl := binary.LittleEndian.Uint32(input[kl+tl+12:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+tl+16:kl+tl+16+vl])
-	e.value = string(valBuf)
-}
+// Decode fills e from a plain record. The length fields are checked
+// against the record and the size limits, so damaged input results in
+// ErrCorruptedRecord.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryHeaderSize || int64(binary.LittleEndian.Uint32(input)) != int64(len(input)) {
+		return ErrCorruptedRecord
+	}
 
-func readValue(in *bufio.Reader) (string, string, error) {
-	header, err := in.Peek(8)
+	key, rest, err := decodeField(input[4:], MaxKeySize)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	valueType, rest, err := decodeField(rest, maxTypeSize)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-
-	header, err = in.Peek(4)
+	value, rest, err := decodeField(rest, MaxValueSize)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", "", err
+	if len(rest) != 0 {
+		return ErrCorruptedRecord
 	}
 
-	dataValue := make([]byte, valSize)
-	n, err := in.Read(dataValue)
-	if err != nil {
-		return "", "", err
+	e.key, e.valueType, e.value = key, valueType, value
+	return nil
+}
+
+func decodeField(data []byte, limit int) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, ErrCorruptedRecord
 	}
-	if n != valSize {
-		return "", "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	n := uint64(binary.LittleEndian.Uint32(data))
+	if n > uint64(limit) || n > uint64(len(data)-4) {
+		return "", nil, ErrCorruptedRecord
 	}
+	return string(data[4 : 4+n]), data[4+n:], nil
+}
+
+// checkSize rejects entries that could not be decoded after being written.
+func checkSize(e entry) error {
+	if len(e.key) > MaxKeySize || len(e.value) > MaxValueSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// maxRecordSize is the size of the largest record allowed by the limits,
+// including the encryption overhead.
+func maxRecordSize() int64 {
+	return int64(entryHeaderSize+MaxKeySize+maxTypeSize+MaxValueSize) + encryptionOverhead
+}
 
-	header, err = in.Peek(4)
+// readValue reads the next plain record and returns its value and type.
+func readValue(in *bufio.Reader) (string, string, error) {
+	data, err := readRecord(in)
 	if err != nil {
 		return "", "", err
 	}
-	typeSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
+	var e entry
+	if err := e.Decode(data); err != nil {
 		return "", "", err
 	}
+	return e.value, e.valueType, nil
+}
 
-	dataType := make([]byte, typeSize)
-	n, err = in.Read(dataType)
+// readRecord returns the bytes of the next record exactly as stored.
+func readRecord(in *bufio.Reader) ([]byte, error) {
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", "", err
+		if err == io.EOF && in.Buffered() > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
-	if n != typeSize {
-		return "", "", fmt.Errorf("can't read type bytes (read %d, expected %d)", n, valSize)
+	size := int64(binary.LittleEndian.Uint32(header) &^ encryptedRecordFlag)
+	if size < entryHeaderSize || size > maxRecordSize() {
+		return nil, ErrCorruptedRecord
 	}
 
-	return string(dataType), string(dataValue), nil
+	// Large records are read into a growing buffer, so that a damaged size
+	// field near the limit costs no more memory than the data really there.
+	var buf bytes.Buffer
+	if size <= recordPreallocSize {
+		buf.Grow(int(size))
+	}
+	n, err := io.CopyN(&buf, in, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes()[:n], err
+}
+
+func readEntry(in *bufio.Reader) (entry, int, error) {
+	var k *keyring
+	return k.readEntry(in)
 }
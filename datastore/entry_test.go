@@ -3,6 +3,8 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
 )
 
@@ -28,3 +30,35 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bad value [%s]", v)
 	}
 }
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	e := entry{"key", "s", "value"}
+	data := e.Encode()
+
+	tooLong := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(tooLong[4:], 1000)
+	empty := entry{"key", "s", ""}
+	hugeValue := empty.Encode()
+	binary.LittleEndian.PutUint32(hugeValue[len(hugeValue)-4:], uint32(MaxValueSize+1))
+
+	for name, input := range map[string][]byte{
+		"empty":          nil,
+		"truncated":      data[:len(data)-1],
+		"trailing bytes": append(append([]byte(nil), data...), 0),
+		"key length":     tooLong,
+		"value length":   hugeValue,
+	} {
+		var got entry
+		if err := got.Decode(input); err != ErrCorruptedRecord {
+			t.Errorf("%s: expected corrupted record error, got %v", name, err)
+		}
+	}
+
+	zeroSize := make([]byte, 20)
+	if _, _, err := readValue(bufio.NewReader(bytes.NewReader(zeroSize))); err != ErrCorruptedRecord {
+		t.Errorf("Expected corrupted record error for zero size, got %v", err)
+	}
+	if _, _, err := readValue(bufio.NewReader(bytes.NewReader(data[:10]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF for a torn record, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const importBatchSize = 100
+
+var errStopExport = fmt.Errorf("export limit reached")
+
+const (
+	exportTypeString = "string"
+	exportTypeInt64  = "int64"
+)
+
+// exportRecord is one line of the JSON Lines export format. TTL is part
+// of the format for stores that expire keys; Db never sets it.
+type exportRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	TTL   int64           `json:"ttl,omitempty"`
+}
+
+func newExportRecord(e entry) (exportRecord, error) {
+	switch e.valueType {
+	case "s":
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return exportRecord{}, err
+		}
+		return exportRecord{Key: e.key, Type: exportTypeString, Value: value}, nil
+	case "i":
+		return exportRecord{Key: e.key, Type: exportTypeInt64, Value: json.RawMessage(e.value)}, nil
+	default:
+		return exportRecord{}, ErrWrongDataType
+	}
+}
+
+func (r exportRecord) entry() (entry, error) {
+	switch r.Type {
+	case exportTypeString:
+		var value string
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			return entry{}, err
+		}
+		return entry{key: r.Key, valueType: "s", value: value}, nil
+	case exportTypeInt64:
+		var value int64
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			return entry{}, err
+		}
+		return entry{key: r.Key, valueType: "i", value: strconv.FormatInt(value, 10)}, nil
+	default:
+		return entry{}, fmt.Errorf("unknown type %q", r.Type)
+	}
+}
+
+// Export writes every key with its latest value to w as JSON Lines, one
+// object per key in ascending key order.
+func (db *Db) Export(w io.Writer) error {
+	_, err := db.streamExport(w, "", "", 0)
+	return err
+}
+
+// ExportRange writes the keys in [start, end) like Export, stopping after
+// limit of them. An empty end means no upper bound and a zero limit no
+// limit; ranges are read one page after another this way.
+func (db *Db) ExportRange(w io.Writer, start, end string, limit int) error {
+	_, err := db.streamExport(w, start, end, limit)
+	return err
+}
+
+// Snapshot writes an Export to w and returns the sequence to Watch from
+// for the changes made after it.
+func (db *Db) Snapshot(w io.Writer) (uint64, error) {
+	return db.streamExport(w, "", "", 0)
+}
+
+// streamExport takes a detached view of the range while holding the read
+// lock and writes it to w only after releasing it, so that a slow reader
+// of w, like a follower across the network, never holds up writes. It
+// returns the sequence of the last change in the export.
+func (db *Db) streamExport(w io.Writer, start, end string, limit int) (uint64, error) {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return 0, ErrClosed
+	}
+	v, err := db.view(start, true)
+	// The next record gets the sequence of the current offset.
+	seq := db.sequence(db.outOffset) - 1
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	defer v.close()
+	return seq, export(w, v, end, limit)
+}
+
+// export writes the JSON Lines of ExportRange from v.
+func export(w io.Writer, v *readView, end string, limit int) error {
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	n := 0
+	err := v.forEach(end, func(e entry) error {
+		if limit > 0 && n == limit {
+			return errStopExport
+		}
+		n++
+		r, err := newExportRecord(e)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(r)
+	})
+	if err != nil && err != errStopExport {
+		return err
+	}
+	return out.Flush()
+}
+
+// Import loads JSON Lines written by Export. Records are written in
+// batches, each going through the write queue as a single request.
+func (db *Db) Import(r io.Reader) error {
+	return db.importRecords(r, nil)
+}
+
+// Replace makes the keys match the JSON Lines written by Export: it imports
+// them and then deletes the keys missing from r.
+func (db *Db) Replace(r io.Reader) error {
+	imported := make(map[string]bool)
+	if err := db.importRecords(r, imported); err != nil {
+		return err
+	}
+
+	var stale []entry
+	err := db.Scan("", "", func(key, value string) error {
+		if !imported[key] {
+			stale = append(stale, entry{key: key, valueType: tombstoneType})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for len(stale) > 0 {
+		n := len(stale)
+		if n > importBatchSize {
+			n = importBatchSize
+		}
+		if err := db.putBatch(stale[:n]); err != nil {
+			return err
+		}
+		stale = stale[n:]
+	}
+	return nil
+}
+
+// importRecords writes the records read from r, adding their keys to
+// imported unless it is nil.
+func (db *Db) importRecords(r io.Reader, imported map[string]bool) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	batch := make([]entry, 0, importBatchSize)
+	for n := 1; ; n++ {
+		var record exportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("record %d: %s", n, err)
+		}
+
+		e, err := record.entry()
+		if err != nil {
+			return fmt.Errorf("record %d: %s", n, err)
+		}
+		if imported != nil {
+			imported[e.key] = true
+		}
+		batch = append(batch, e)
+		if len(batch) == importBatchSize {
+			if err := db.putBatch(batch); err != nil {
+				return err
+			}
+			batch = make([]entry, 0, importBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		return db.putBatch(batch)
+	}
+	return nil
+}
+
+func (db *Db) putBatch(entries []entry) error {
+	return db.send(context.Background(), entryWithResp{
+		batch:    entries,
+		response: make(chan error, 1),
+	})
+}
@@ -0,0 +1,238 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_ExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		for k := 0; k < 20; k++ {
+			if err := db.Put(fmt.Sprintf("key%02d", k), fmt.Sprintf("value \"%d\"-%d", k, i)); err != nil {
+				t.Fatalf("Cannot put key%02d: %s", k, err)
+			}
+		}
+	}
+	if err := db.PutInt64("number", -12); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := db.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("export", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 21 {
+			t.Fatalf("Expected 21 records, got %d", len(lines))
+		}
+		if lines[0] != `{"key":"key00","type":"string","value":"value \"0\"-1"}` {
+			t.Errorf("Unexpected first record %s", lines[0])
+		}
+		if lines[20] != `{"key":"number","type":"int64","value":-12}` {
+			t.Errorf("Unexpected last record %s", lines[20])
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		var page bytes.Buffer
+		if err := db.ExportRange(&page, "key05", "key10", 3); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(page.String()), "\n")
+		if len(lines) != 3 || !strings.Contains(lines[0], `"key05"`) || !strings.Contains(lines[2], `"key07"`) {
+			t.Errorf("Unexpected page %q", lines)
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		importDir := filepath.Join(dir, "import")
+		if err := os.Mkdir(importDir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		imported, err := NewDb(currentFile, importDir, 300, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer imported.Close()
+
+		if err := imported.Import(bytes.NewReader(out.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 20; k++ {
+			value, err := imported.Get(fmt.Sprintf("key%02d", k))
+			if err != nil {
+				t.Fatalf("Cannot get key%02d: %s", k, err)
+			}
+			if value != fmt.Sprintf("value \"%d\"-1", k) {
+				t.Errorf("Bad value returned for key%02d: %s", k, value)
+			}
+		}
+		if v, err := imported.GetInt64("number"); err != nil || v != -12 {
+			t.Errorf("Bad int64 value %d (%v)", v, err)
+		}
+
+		err = imported.Import(strings.NewReader(`{"key":"a","type":"float","value":1}`))
+		if err == nil {
+			t.Errorf("Expected error for unknown type")
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		replaceDir := filepath.Join(dir, "replace")
+		if err := os.Mkdir(replaceDir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		replica, err := NewDb(currentFile, replaceDir, 300, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer replica.Close()
+		if err := replica.Put("stale", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.Put("key05", "old"); err != nil {
+			t.Fatal(err)
+		}
+
+		var snapshot bytes.Buffer
+		seq, err := db.Snapshot(&snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.Replace(&snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := replica.Get("stale"); err != ErrNotFound {
+			t.Errorf("Expected a key missing from the snapshot to be deleted, got %v", err)
+		}
+		if value, err := replica.Get("key05"); err != nil || value != `value "5"-1` {
+			t.Errorf("Bad value returned for key05: %q (%v)", value, err)
+		}
+
+		if err := db.Put("after", "snapshot"); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes, err := db.Watch(ctx, "", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := <-changes; c.Key != "after" {
+			t.Errorf("Expected the watch from the snapshot to start with after, got %+v", c)
+		}
+	})
+
+	t.Run("slow reader", func(t *testing.T) {
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := db.Snapshot(w)
+			w.CloseWithError(err)
+			done <- err
+		}()
+		// Nobody reads the pipe yet, so the snapshot is stuck writing.
+		put := make(chan error, 1)
+		go func() { put <- db.Put("during", "snapshot") }()
+		select {
+		case err := <-put:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("A put waited for the reader of a snapshot")
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDb_SnapshotDuringMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 500, true, WithDiskIndex(), WithValueLog(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	long := strings.Repeat("v", 40)
+	put := func(round int) {
+		for k := 0; k < 200; k++ {
+			if err := db.Put(fmt.Sprintf("key%03d", k), fmt.Sprintf("%s-%d", long, round)); err != nil {
+				t.Fatalf("Cannot put key%03d: %s", k, err)
+			}
+		}
+	}
+	put(0)
+	var expected bytes.Buffer
+	if err := db.Export(&expected); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Snapshot(w)
+		w.CloseWithError(err)
+		done <- err
+	}()
+	// The export is larger than its write buffer, so reading the first
+	// byte leaves it halfway. Merges and value log collection then remove
+	// files it still reads from.
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatal(err)
+	}
+	for round := 1; round < 4; round++ {
+		put(round)
+		for i := 0; i < 3; i++ {
+			if err := db.CollectValueLog(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := string(first) + string(rest); got != expected.String() {
+		t.Errorf("Expected the snapshot to hold the keys of when it started:\n%s\ngot:\n%s", expected.String(), got)
+	}
+}
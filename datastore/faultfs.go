@@ -0,0 +1,206 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrInjected = fmt.Errorf("injected file system fault")
+
+// Fault is what a FaultFS does to the operation it was injected at.
+type Fault int
+
+const (
+	// FailOp makes the operation fail without any effect.
+	FailOp Fault = iota
+	// TearWrite makes a write store only the first half of its data before
+	// failing. Other operations fail as with FailOp.
+	TearWrite
+	// Crash tears the operation as TearWrite does and fails every
+	// operation after it, as if the process died there. The underlying
+	// FS then holds what a restarted process would find.
+	Crash
+)
+
+// FaultFS wraps an FS and fails one chosen operation. Operations are
+// numbered from 1 in the order they change the file system: opening a
+// file for writing, writes, syncs, truncations, renames, removals and
+// directory creation. Reads are not counted but fail after a Crash.
+type FaultFS struct {
+	fs FS
+
+	mu      sync.Mutex
+	ops     int
+	at      int
+	fault   Fault
+	crashed bool
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// Inject makes the op-th operation, counted from the start, fail with
+// fault. Zero disables injection.
+func (f *FaultFS) Inject(op int, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.at = op
+	f.fault = fault
+}
+
+// Ops returns the number of operations counted so far.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// Crashed reports whether an injected Crash happened.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// op counts a changing operation. A nil error lets it through, otherwise
+// tear tells whether a write should store part of its data first.
+func (f *FaultFS) op() (tear bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return false, ErrInjected
+	}
+	f.ops++
+	if f.ops != f.at {
+		return false, nil
+	}
+	if f.fault == Crash {
+		f.crashed = true
+	}
+	return f.fault != FailOp, ErrInjected
+}
+
+func (f *FaultFS) read() error {
+	if f.Crashed() {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if _, err := f.op(); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	} else if err := f.read(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(name)
+}
+
+func (f *FaultFS) MkdirAll(name string, perm os.FileMode) error {
+	if _, err := f.op(); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(name, perm)
+}
+
+func (f *FaultFS) Rename(oldName, newName string) error {
+	if _, err := f.op(); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldName, newName)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if _, err := f.op(); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) RemoveAll(name string) error {
+	if _, err := f.op(); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(name)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	if _, err := f.op(); err != nil {
+		return err
+	}
+	return f.fs.SyncDir(name)
+}
+
+// Lock is passed through without faults, so that a crashed Db can still
+// release the directory for the next one.
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	return f.fs.Lock(name)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.read(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.read(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	tear, err := f.fs.op()
+	if err == nil {
+		return f.File.Write(p)
+	}
+	if !tear {
+		return 0, err
+	}
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.op(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.fs.op(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
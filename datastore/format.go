@@ -0,0 +1,239 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Data files written by Db start with a header naming the format version,
+// so that the record layout can change without breaking existing
+// directories. Files written before the header was introduced are read as
+// version 0: plain files start right with the first record, compressed
+// ones with four zero bytes and the codec.
+const (
+	formatMagic    = "KVDB"
+	formatVersion  = 1
+	fileHeaderSize = 8
+)
+
+var ErrUnsupportedVersion = fmt.Errorf("unsupported data file version")
+
+// fileHeader is the magic, the version, the segment codec and two
+// reserved bytes.
+type fileHeader struct {
+	version int
+	codec   byte
+}
+
+// encode returns the header in the layout of its version. Plain version 0
+// files have none.
+func (h fileHeader) encode() []byte {
+	if h.version == 0 {
+		if h.codec == 0 {
+			return nil
+		}
+		res := make([]byte, segmentHeaderSize)
+		res[4] = h.codec
+		return res
+	}
+	res := make([]byte, fileHeaderSize)
+	copy(res, formatMagic)
+	res[4] = byte(h.version)
+	res[5] = h.codec
+	return res
+}
+
+// size returns the number of bytes before the first record or block.
+func (h fileHeader) size() int64 {
+	if h.version > 0 {
+		return fileHeaderSize
+	}
+	if h.codec != 0 {
+		return segmentHeaderSize
+	}
+	return 0
+}
+
+// dataStart returns the offset of the first record in the uncompressed
+// record stream, which is what index offsets refer to.
+func (h fileHeader) dataStart() int64 {
+	if h.version > 0 {
+		return fileHeaderSize
+	}
+	return 0
+}
+
+// readFileHeader consumes the header at the start of in. An empty file
+// reads as a version 0 file without records.
+func readFileHeader(in *bufio.Reader) (fileHeader, error) {
+	data, err := in.Peek(fileHeaderSize)
+	if len(data) >= len(formatMagic) && string(data[:len(formatMagic)]) == formatMagic {
+		if err != nil {
+			return fileHeader{}, io.ErrUnexpectedEOF
+		}
+		h := fileHeader{version: int(data[4]), codec: data[5]}
+		if h.version > formatVersion {
+			return h, fmt.Errorf("%w %d", ErrUnsupportedVersion, h.version)
+		}
+		_, err := in.Discard(fileHeaderSize)
+		return h, err
+	}
+	if len(data) >= segmentHeaderSize && binary.LittleEndian.Uint32(data) == 0 {
+		h := fileHeader{codec: data[4]}
+		_, err := in.Discard(segmentHeaderSize)
+		return h, err
+	}
+	return fileHeader{}, nil
+}
+
+func readFileHeaderAt(fs FS, path string) (fileHeader, error) {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+	return readFileHeader(bufio.NewReader(f))
+}
+
+// openDataFile opens a record file for appending and returns its size. A
+// new file gets the header of the current version first, and so does one
+// a crash left with part of the header only; no record is that short.
+func openDataFile(fs FS, path string) (File, int64, error) {
+	f, err := fs.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if info.Size() >= fileHeaderSize {
+		return f, info.Size(), nil
+	}
+	if info.Size() > 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Write(fileHeader{version: formatVersion}.encode()); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fileHeaderSize, nil
+}
+
+// Upgrade rewrites the sealed segments and the current file of a stopped
+// database in dir in the latest format version and returns the names of
+// the rewritten files. Value log files keep their version, as value
+// pointers address them by offset; they stay readable and are replaced by
+// value log collection over time. It fails with ErrLocked while the
+// directory is open.
+func Upgrade(dir string, opts ...Option) ([]string, error) {
+	keys, err := optionKeys(opts)
+	if err != nil {
+		return nil, err
+	}
+	fs := optionFS(opts)
+	lock, err := lockDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	m, err := readManifest(fs, dir)
+	if os.IsNotExist(err) {
+		m = manifest{}
+	} else if err != nil {
+		return nil, err
+	}
+	if m.current == "" {
+		m.current = currentFile
+	}
+
+	var upgraded []string
+	for _, name := range append(append([]string(nil), m.segments...), m.current) {
+		path := filepath.Join(dir, name)
+		h, err := readFileHeaderAt(fs, path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return upgraded, fmt.Errorf("%s: %w", name, err)
+		}
+		if h.version == formatVersion {
+			continue
+		}
+		if err := upgradeFile(fs, path, h, keys); err != nil {
+			return upgraded, fmt.Errorf("%s: %w", name, err)
+		}
+		upgraded = append(upgraded, name)
+	}
+	return upgraded, nil
+}
+
+// upgradeFile copies the records of a data file into a new one with the
+// current header, keeping its compression. Record offsets move, so an old
+// index file is removed before the new data file takes its place; a
+// missing index is rebuilt on open, a stale one would point to wrong
+// records. The new file is synced before the rename and the directory
+// after it, so a crash leaves either the old file or the new one.
+func upgradeFile(fs FS, path string, h fileHeader, keys *keyring) error {
+	tmpPath := path + ".tmp"
+	if err := fs.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, offset, err := openDataFile(fs, tmpPath)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(f)
+	index := make(hashIndex)
+	err = readRecords(fs, path, keys, func(data []byte, e entry, _ int64) error {
+		index[e.key] = offset
+		offset += int64(len(data))
+		_, err := out.Write(data)
+		return err
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := closeSynced(f); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(tmpPath)
+		return err
+	}
+	if h.codec != 0 {
+		if _, err := compressSegment(fs, tmpPath); err != nil {
+			fs.Remove(tmpPath)
+			return err
+		}
+	}
+
+	indexPath := path + indexFileSuffix
+	_, statErr := fs.Stat(indexPath)
+	if err := fs.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if err := fs.SyncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if statErr != nil {
+		return nil
+	}
+	idx, err := writeDiskIndex(fs, indexPath, index)
+	if err != nil {
+		return err
+	}
+	return idx.close()
+}
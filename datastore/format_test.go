@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLegacyFile(t *testing.T, path string, entries []entry) {
+	var data []byte
+	for _, e := range entries {
+		data = append(data, e.Encode()...)
+	}
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := make(map[string]string)
+	files := make([][]entry, 3)
+	for i := range files {
+		for k := 0; k < 10; k++ {
+			e := entry{key: fmt.Sprintf("key%d", k+i*3), valueType: "s", value: fmt.Sprintf("value%d-%d", k, i)}
+			files[i] = append(files[i], e)
+			expected[e.key] = e.value
+		}
+	}
+	writeLegacyFile(t, filepath.Join(dir, outFileName+"1"), files[0])
+	writeLegacyFile(t, filepath.Join(dir, outFileName+"2"), files[1])
+	if _, err := compressSegment(osFS{}, filepath.Join(dir, outFileName+"2")); err != nil {
+		t.Fatal(err)
+	}
+	writeLegacyFile(t, filepath.Join(dir, currentFile), files[2])
+	m := manifest{current: currentFile, next: 2, segments: []string{outFileName + "1", outFileName + "2"}}
+	if err := writeManifest(osFS{}, dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		db, err := NewDb(currentFile, dir, 1000, false, WithDiskIndex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if got != value {
+				t.Errorf("Bad value returned for %s: expected %s, got %s", key, value, got)
+			}
+		}
+	}
+
+	t.Run("read version 0", func(t *testing.T) {
+		check(t)
+		db, err := NewDb(currentFile, dir, 1000, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("later", "value"); err != nil {
+			t.Fatal(err)
+		}
+		expected["later"] = "value"
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		upgraded, err := Upgrade(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upgraded) != 3 {
+			t.Errorf("Expected 3 upgraded files, got %v", upgraded)
+		}
+		for _, name := range upgraded {
+			h, err := readFileHeaderAt(osFS{}, filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.version != formatVersion {
+				t.Errorf("File %s has version %d", name, h.version)
+			}
+		}
+		if h, _ := readFileHeaderAt(osFS{}, filepath.Join(dir, outFileName+"2")); h.codec != segmentCodecFlate {
+			t.Error("Upgraded segment is not compressed anymore")
+		}
+		check(t)
+
+		upgraded, err = Upgrade(dir)
+		if err != nil || len(upgraded) != 0 {
+			t.Errorf("Second upgrade rewrote %v (%v)", upgraded, err)
+		}
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		newer := filepath.Join(dir, "newer")
+		if err := os.Mkdir(newer, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		header := fileHeader{version: formatVersion + 1}.encode()
+		if err := ioutil.WriteFile(filepath.Join(newer, currentFile), header, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewDb(currentFile, newer, 1000, false)
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("Expected unsupported version error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FS is the file system a Db keeps its directory on. Paths are the ones
+// the Db builds with filepath.Join from its directory.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	// SyncDir makes the files created, renamed and removed in a directory
+	// so far survive a crash.
+	SyncDir(name string) error
+	// Lock takes an exclusive lock named by a file, failing with
+	// ErrLocked if it is held. Closing the result releases it.
+	Lock(name string) (io.Closer, error)
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WithFS keeps the database on fs instead of the operating system file
+// system.
+func WithFS(fs FS) Option {
+	return func(db *Db) {
+		db.fs = fs
+	}
+}
+
+// optionFS returns the file system set by opts.
+func optionFS(opts []Option) FS {
+	db := &Db{}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return orOSFS(db.fs)
+}
+
+func orOSFS(fs FS) FS {
+	if fs == nil {
+		return osFS{}
+	}
+	return fs
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error)   { return ioutil.ReadDir(name) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Rename(oldName, newName string) error         { return os.Rename(oldName, newName) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFS) SyncDir(name string) error                    { return syncDir(name) }
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := openLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func openRead(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func createFile(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+}
+
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := openRead(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// closeSynced syncs f before closing it, for files that are renamed over
+// others or listed in the manifest next.
+func closeSynced(f File) error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFile writes data to name and syncs it, so that it can be renamed
+// over a file it replaces.
+func writeFile(fs FS, name string, data []byte) error {
+	f, err := createFile(fs, name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
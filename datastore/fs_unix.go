@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package datastore
+
+import "os"
+
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,7 @@
+package datastore
+
+// syncDir does nothing, as Windows cannot sync directories; NTFS journals
+// the changes to them.
+func syncDir(name string) error {
+	return nil
+}
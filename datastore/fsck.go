@@ -0,0 +1,636 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// quarantineDir keeps files and cut off tails that Repair took out of a
+// data directory, so that nothing is lost for good.
+const quarantineDir = "quarantine"
+
+// Kinds of problems reported by Check.
+const (
+	ProblemMissingManifest    = "missing manifest"
+	ProblemBadManifest        = "bad manifest"
+	ProblemMissingFile        = "missing file"
+	ProblemDuplicateSegment   = "duplicate segment"
+	ProblemOverlappingSegment = "overlapping segment"
+	ProblemTornTail           = "torn tail"
+	ProblemBadRecord          = "bad record"
+	ProblemUnreadableSegment  = "unreadable segment"
+	ProblemBadIndex           = "bad index"
+	ProblemOrphanedFile       = "orphaned file"
+	ProblemUnlistedSegment    = "unlisted segment"
+	ProblemDanglingPointer    = "dangling value pointer"
+)
+
+// Problem is an inconsistency found in a data directory. Offset is -1 if
+// the problem concerns a whole file.
+type Problem struct {
+	File     string
+	Offset   int64
+	Kind     string
+	Detail   string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.File
+	if p.Offset >= 0 {
+		s += fmt.Sprintf(" at %d", p.Offset)
+	}
+	s += ": " + p.Kind
+	if p.Detail != "" {
+		s += " (" + p.Detail + ")"
+	}
+	if p.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// CheckReport lists what Check or Repair found in a data directory.
+type CheckReport struct {
+	Files    int
+	Records  int
+	Problems []Problem
+}
+
+// OK reports whether the directory has no problems left.
+func (r *CheckReport) OK() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Check reads every file of a stopped database in dir and reports damaged
+// records, segments the manifest gets wrong, stale indexes and files that
+// do not belong to the database. Only the encryption options matter. It
+// fails with ErrLocked while the directory is open and with ErrEncrypted
+// if records are encrypted and no key is given.
+func Check(dir string, opts ...Option) (*CheckReport, error) {
+	return checkDir(dir, false, opts)
+}
+
+// Repair runs Check and fixes what it can: torn tails are truncated,
+// unreadable and orphaned segments are moved to the quarantine directory,
+// indexes are rebuilt and the manifest is rewritten to match.
+func Repair(dir string, opts ...Option) (*CheckReport, error) {
+	return checkDir(dir, true, opts)
+}
+
+type pointerRef struct {
+	file   string
+	offset int64
+	value  string
+}
+
+type checker struct {
+	fs     FS
+	dir    string
+	keys   *keyring
+	repair bool
+	report CheckReport
+
+	valueLogs map[int]int64
+	pointers  map[string]*pointerRef
+}
+
+func checkDir(dir string, repair bool, opts []Option) (*CheckReport, error) {
+	keys, err := optionKeys(opts)
+	if err != nil {
+		return nil, err
+	}
+	fs := optionFS(opts)
+	lock, err := lockDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	c := &checker{
+		fs:        fs,
+		dir:       dir,
+		keys:      keys,
+		repair:    repair,
+		valueLogs: make(map[int]int64),
+		pointers:  make(map[string]*pointerRef),
+	}
+
+	m, changed, err := c.checkManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkValueLogs(); err != nil {
+		return nil, err
+	}
+	segmentsChanged, err := c.checkSegments(&m)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkCurrent(m.current); err != nil {
+		return nil, err
+	}
+	c.checkPointers()
+	if err := c.checkOrphans(m); err != nil {
+		return nil, err
+	}
+
+	if c.repair && (changed || segmentsChanged) {
+		if err := writeManifest(fs, dir, m); err != nil {
+			return nil, err
+		}
+	}
+	return &c.report, nil
+}
+
+func (c *checker) add(file string, offset int64, kind string, detail interface{}, repaired bool) {
+	p := Problem{File: file, Offset: offset, Kind: kind, Repaired: repaired}
+	if detail != nil {
+		p.Detail = fmt.Sprint(detail)
+	}
+	c.report.Problems = append(c.report.Problems, p)
+}
+
+// checkManifest reads the manifest. Without one, sealed segments found in
+// the directory are taken in the order of their numbers.
+func (c *checker) checkManifest() (manifest, bool, error) {
+	m, readErr := readManifest(c.fs, c.dir)
+	if readErr == nil {
+		c.report.Files++
+		if m.current == "" {
+			m.current = currentFile
+		}
+		adopted, err := adoptSegments(c.fs, c.dir, &m)
+		if err != nil {
+			return manifest{}, false, err
+		}
+		for _, name := range adopted {
+			c.add(name, -1, ProblemUnlistedSegment, nil, c.repair)
+		}
+		return m, len(adopted) > 0, nil
+	}
+
+	numbers, err := c.segmentNumbers()
+	if err != nil {
+		return manifest{}, false, err
+	}
+	m = manifest{current: currentFile}
+	for _, n := range numbers {
+		m.segments = append(m.segments, outFileName+strconv.Itoa(n))
+		m.next = n
+	}
+	if !os.IsNotExist(readErr) {
+		c.add(manifestFile, -1, ProblemBadManifest, readErr, c.repair)
+		return m, true, nil
+	}
+	if len(numbers) > 0 {
+		c.add(manifestFile, -1, ProblemMissingManifest, nil, c.repair)
+	}
+	return m, len(numbers) > 0, nil
+}
+
+func (c *checker) segmentNumbers() ([]int, error) {
+	files, err := c.fs.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for _, f := range files {
+		if n, ok := segmentNumber(f.Name()); ok {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func segmentNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, outFileName) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
+	return n, err == nil
+}
+
+func (c *checker) checkValueLogs() error {
+	files, err := c.fs.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, valueLogPrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(name, valueLogPrefix))
+		if err != nil {
+			continue
+		}
+
+		c.report.Files++
+		scan, err := c.scanFile(name, func(entry, int64) {})
+		if err != nil {
+			return err
+		}
+		c.valueLogs[id] = scan.end
+		switch scan.kind {
+		case ProblemTornTail:
+			if c.repair {
+				if err := c.truncate(name, scan.end); err != nil {
+					return err
+				}
+			}
+			c.add(name, scan.end, scan.kind, scan.err, c.repair)
+		case ProblemBadRecord:
+			// Pointers refer to the records behind this one by offset, so
+			// it cannot be cut out.
+			c.add(name, scan.end, scan.kind, scan.err, false)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkSegments(m *manifest) (bool, error) {
+	changed := false
+	seen := make(map[string]bool)
+	var live []string
+	for _, name := range m.segments {
+		if seen[name] {
+			c.add(name, -1, ProblemDuplicateSegment, nil, c.repair)
+			changed = true
+			continue
+		}
+		seen[name] = true
+		if n, ok := segmentNumber(name); ok && n > m.next {
+			c.add(name, -1, ProblemOverlappingSegment, fmt.Sprintf("next segment number is %d", m.next+1), c.repair)
+			m.next = n
+			changed = true
+		}
+
+		problems := len(c.report.Problems)
+		keep, err := c.checkSegment(name)
+		if err != nil {
+			return false, err
+		}
+		if c.repair && len(c.report.Problems) > problems {
+			// The counts no longer match; the Db counts the records again.
+			if _, ok := m.usage[name]; ok {
+				delete(m.usage, name)
+				changed = true
+			}
+		}
+		if keep {
+			live = append(live, name)
+		} else {
+			changed = true
+		}
+	}
+	if c.repair {
+		m.segments = live
+	}
+	return changed, nil
+}
+
+// checkSegment checks one sealed segment and its index, and reports
+// whether the segment stays in the manifest after a repair.
+func (c *checker) checkSegment(name string) (bool, error) {
+	path := filepath.Join(c.dir, name)
+	if _, err := c.fs.Stat(path); os.IsNotExist(err) {
+		c.add(name, -1, ProblemMissingFile, nil, c.repair)
+		return false, nil
+	}
+
+	c.report.Files++
+	pointers := make(map[string]*pointerRef)
+	scan, err := c.scanFile(name, c.collectPointers(name, pointers))
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case scan.kind == ProblemTornTail && !scan.compressed:
+		if c.repair {
+			if err := c.truncate(name, scan.end); err != nil {
+				return false, err
+			}
+		}
+		c.add(name, scan.end, scan.kind, scan.err, c.repair)
+	case scan.kind != "":
+		if c.repair {
+			if err := c.quarantine(name); err != nil {
+				return false, err
+			}
+			c.fs.Remove(path + indexFileSuffix)
+		}
+		kind := scan.kind
+		if scan.compressed {
+			kind = ProblemUnreadableSegment
+		}
+		c.add(name, scan.end, kind, scan.err, c.repair)
+		return false, nil
+	}
+
+	for key, ref := range pointers {
+		c.pointers[key] = ref
+	}
+	return true, c.checkIndex(name, scan.index)
+}
+
+func (c *checker) checkIndex(name string, index hashIndex) error {
+	path := filepath.Join(c.dir, name+indexFileSuffix)
+	if _, err := c.fs.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	c.report.Files++
+	err := verifyDiskIndex(c.fs, path, index)
+	if err == nil {
+		return nil
+	}
+	if c.repair {
+		idx, err := writeDiskIndex(c.fs, path, index)
+		if err != nil {
+			return err
+		}
+		idx.close()
+	}
+	c.add(name+indexFileSuffix, -1, ProblemBadIndex, err, c.repair)
+	return nil
+}
+
+func verifyDiskIndex(fs FS, path string, index hashIndex) error {
+	idx, err := openDiskIndex(fs, path)
+	if err != nil {
+		return err
+	}
+	defer idx.close()
+
+	it, err := idx.iterator("")
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ; it.valid(); it.next() {
+		k := it.current()
+		if offset, ok := index[k.key]; !ok || offset != k.offset {
+			return fmt.Errorf("wrong offset %d for key %q", k.offset, k.key)
+		}
+		n++
+	}
+	if it.err() != nil {
+		return it.err()
+	}
+	if n != len(index) {
+		return fmt.Errorf("index has %d keys, segment has %d", n, len(index))
+	}
+	return nil
+}
+
+// checkCurrent checks the file new records are appended to. Everything
+// after the first damaged record is cut off, as Db cannot open it otherwise.
+func (c *checker) checkCurrent(name string) error {
+	if _, err := c.fs.Stat(filepath.Join(c.dir, name)); os.IsNotExist(err) {
+		return nil
+	}
+
+	c.report.Files++
+	scan, err := c.scanFile(name, c.collectPointers(name, c.pointers))
+	if err != nil {
+		return err
+	}
+	if scan.kind == "" {
+		return nil
+	}
+	if c.repair {
+		if err := c.truncate(name, scan.end); err != nil {
+			return err
+		}
+	}
+	c.add(name, scan.end, scan.kind, scan.err, c.repair)
+	return nil
+}
+
+// collectPointers tracks the value pointers that are the latest record of
+// their key; older ones may point to value log files collected long ago.
+func (c *checker) collectPointers(name string, pointers map[string]*pointerRef) func(entry, int64) {
+	return func(e entry, offset int64) {
+		if isValuePointer(e.valueType) {
+			pointers[e.key] = &pointerRef{file: name, offset: offset, value: e.value}
+		} else {
+			pointers[e.key] = nil
+		}
+	}
+}
+
+func (c *checker) checkPointers() {
+	keys := make([]string, 0, len(c.pointers))
+	for key, ref := range c.pointers {
+		if ref != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ref := c.pointers[key]
+		p, err := decodeValuePointer(ref.value)
+		if err != nil {
+			c.add(ref.file, ref.offset, ProblemDanglingPointer, err, false)
+			continue
+		}
+		size, ok := c.valueLogs[p.file]
+		if !ok || p.offset+int64(p.size) > size {
+			c.add(ref.file, ref.offset, ProblemDanglingPointer,
+				fmt.Sprintf("key %q points to %s%d at %d", key, valueLogPrefix, p.file, p.offset), false)
+		}
+	}
+}
+
+// checkOrphans looks for segments the manifest does not list and for
+// leftovers of interrupted merges and manifest updates.
+func (c *checker) checkOrphans(m manifest) error {
+	live := make(map[string]bool)
+	for _, name := range m.segments {
+		live[name] = true
+	}
+
+	files, err := c.fs.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		segment := strings.TrimSuffix(name, indexFileSuffix)
+		switch {
+		case strings.HasPrefix(name, mergeFileName) || strings.HasSuffix(name, ".tmp"):
+			if c.repair {
+				if err := c.fs.RemoveAll(filepath.Join(c.dir, name)); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(name, outFileName) && !live[segment]:
+			if _, ok := segmentNumber(segment); !ok {
+				continue
+			}
+			if c.repair {
+				if segment == name {
+					err = c.quarantine(name)
+				} else {
+					err = c.fs.Remove(filepath.Join(c.dir, name))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			continue
+		}
+		c.add(name, -1, ProblemOrphanedFile, nil, c.repair)
+	}
+	return nil
+}
+
+type fileScan struct {
+	index      hashIndex
+	compressed bool
+	end        int64
+	kind       string
+	err        error
+}
+
+// scanFile walks the records of a segment, current or value log file up to
+// the first one that cannot be read. For plain files end is the offset
+// where the readable part of the file ends.
+func (c *checker) scanFile(name string, fn func(e entry, offset int64)) (fileScan, error) {
+	path := filepath.Join(c.dir, name)
+	f, err := openRead(c.fs, path)
+	if err != nil {
+		return fileScan{}, err
+	}
+	defer f.Close()
+
+	scan := fileScan{index: make(hashIndex)}
+	record := func(e entry, offset int64) {
+		scan.index[e.key] = offset
+		fn(e, offset)
+	}
+
+	blocks, err := loadSegmentBlocks(c.fs, path)
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return fileScan{}, fmt.Errorf("%s: %w", name, err)
+	} else if err == io.ErrUnexpectedEOF {
+		scan.kind, scan.err = ProblemTornTail, err
+		return scan, nil
+	} else if err != nil {
+		scan.compressed = true
+		scan.kind, scan.err = ProblemUnreadableSegment, err
+		return scan, nil
+	}
+	if blocks == nil {
+		in := bufio.NewReader(f)
+		h, err := readFileHeader(in)
+		if err != nil {
+			return fileScan{}, err
+		}
+		scan.end, scan.kind, scan.err = c.walk(in, h.size(), record)
+		if scan.kind == "" && scan.err != nil {
+			return fileScan{}, fmt.Errorf("%s: %w", name, scan.err)
+		}
+		return scan, nil
+	}
+
+	scan.compressed = true
+	for _, b := range blocks {
+		data, err := readBlock(f, b)
+		if err != nil {
+			scan.end, scan.kind, scan.err = b.fileOffset, ProblemUnreadableSegment, err
+			return scan, nil
+		}
+		_, scan.kind, scan.err = c.walk(bufio.NewReader(bytes.NewReader(data)), b.rawOffset, record)
+		if scan.kind == "" && scan.err != nil {
+			return fileScan{}, fmt.Errorf("%s: %w", name, scan.err)
+		} else if scan.kind != "" {
+			scan.end = b.fileOffset
+			return scan, nil
+		}
+	}
+	return scan, nil
+}
+
+// walk reads records starting at offset until the end of in or the first
+// record that cannot be read, and returns the offset it stopped at. An
+// encrypted record without a key to read it is no problem of the file but
+// an error without a problem kind.
+func (c *checker) walk(in *bufio.Reader, offset int64, fn func(e entry, offset int64)) (int64, string, error) {
+	for {
+		data, err := readRecord(in)
+		if err == io.EOF {
+			return offset, "", nil
+		} else if err == io.ErrUnexpectedEOF {
+			return offset, ProblemTornTail, err
+		} else if err != nil {
+			return offset, ProblemBadRecord, err
+		}
+		e, err := c.keys.decode(data)
+		if err == ErrEncrypted {
+			// The record is fine, the key is missing: every later one would
+			// look damaged too.
+			return offset, "", err
+		} else if err != nil {
+			return offset, ProblemBadRecord, err
+		}
+		c.report.Records++
+		fn(e, offset)
+		offset += int64(len(data))
+	}
+}
+
+// truncate cuts a file at offset and keeps the removed bytes in the
+// quarantine directory.
+func (c *checker) truncate(name string, offset int64) error {
+	path := filepath.Join(c.dir, name)
+	f, err := c.fs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := c.fs.MkdirAll(filepath.Join(c.dir, quarantineDir), 0o700); err != nil {
+		return err
+	}
+	tail, err := createFile(c.fs, filepath.Join(c.dir, quarantineDir, fmt.Sprintf("%s.tail-%d", name, offset)))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tail, io.NewSectionReader(f, offset, info.Size()-offset))
+	if closeErr := tail.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return f.Truncate(offset)
+}
+
+func (c *checker) quarantine(name string) error {
+	if err := c.fs.MkdirAll(filepath.Join(c.dir, quarantineDir), 0o700); err != nil {
+		return err
+	}
+	return c.fs.Rename(filepath.Join(c.dir, name), filepath.Join(c.dir, quarantineDir, name))
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, false, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for k := 0; k < 20; k++ {
+			if err := db.Put(fmt.Sprintf("key%d", k), fmt.Sprintf("value%d-%d", k, i)); err != nil {
+				t.Fatalf("Cannot put key%d: %s", k, err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != 40 {
+		t.Fatalf("Unexpected report for a clean directory: %d records, %v", report.Records, report.Problems)
+	}
+
+	// The first segment only holds values from the first round.
+	segment := filepath.Join(dir, outFileName+"1")
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Break the key length of its second record.
+	second := fileHeaderSize + binary.LittleEndian.Uint32(data[fileHeaderSize:])
+	binary.LittleEndian.PutUint32(data[second+4:], 0xffff)
+	if err := ioutil.WriteFile(segment, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.OpenFile(filepath.Join(dir, currentFile), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entry{key: "torn", valueType: "s", value: "value"}
+	if _, err := current.Write(e.Encode()[:10]); err != nil {
+		t.Fatal(err)
+	}
+	current.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, mergeFileName+"7"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(dir, outFileName+"2"+indexFileSuffix), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := func(r *CheckReport) map[string]bool {
+		res := make(map[string]bool)
+		for _, p := range r.Problems {
+			res[p.Kind] = true
+		}
+		return res
+	}
+
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := kinds(report)
+	for _, kind := range []string{ProblemBadRecord, ProblemTornTail, ProblemOrphanedFile, ProblemBadIndex} {
+		if !found[kind] {
+			t.Errorf("Expected %q problem, got %v", kind, report.Problems)
+		}
+	}
+	if report.OK() {
+		t.Error("Check reports a damaged directory as OK")
+	}
+
+	report, err = Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Problems left after repair: %v", report.Problems)
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDir, outFileName+"1")); err != nil {
+		t.Errorf("Damaged segment is not quarantined: %s", err)
+	}
+
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Problems found after repair: %v", report.Problems)
+	}
+
+	db, err = NewDb(currentFile, dir, 300, false, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k := 0; k < 20; k++ {
+		value, err := db.Get(fmt.Sprintf("key%d", k))
+		if err != nil {
+			t.Fatalf("Cannot get key%d: %s", k, err)
+		}
+		if value != fmt.Sprintf("value%d-1", k) {
+			t.Errorf("Bad value returned for key%d: %s", k, value)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+const (
+	indexFileSuffix = ".idx"
+	indexSampleRate = 64
+)
+
+// segmentIndex maps keys of a sealed segment to record offsets. Its
+// iterator yields the keys from start on in ascending order, which lets
+// merges and scans stream several segments at once without building a
+// combined key set.
+type segmentIndex interface {
+	get(key string) (int64, bool, error)
+	iterator(start string) (indexIterator, error)
+	close() error
+}
+
+type indexIterator interface {
+	valid() bool
+	current() sparseKey
+	next() bool
+	err() error
+}
+
+func (i hashIndex) get(key string) (int64, bool, error) {
+	position, ok := i[key]
+	return position, ok, nil
+}
+
+func (i hashIndex) sorted(start string) []sparseKey {
+	var res []sparseKey
+	for key, offset := range i {
+		if key >= start {
+			res = append(res, sparseKey{key: key, offset: offset})
+		}
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].key < res[b].key })
+	return res
+}
+
+// iterator sorts the keys on every call, which only the index of the
+// current file, bounded by the segment size, has to do.
+func (i hashIndex) iterator(start string) (indexIterator, error) {
+	return &keySliceIterator{keys: i.sorted(start)}, nil
+}
+
+func (i hashIndex) close() error {
+	return nil
+}
+
+// sortedIndex is the index of a sealed segment kept in memory. The keys
+// of a sealed segment never change, so they are sorted once and looked up
+// with a binary search.
+type sortedIndex []sparseKey
+
+func (i sortedIndex) search(key string) int {
+	return sort.Search(len(i), func(n int) bool { return i[n].key >= key })
+}
+
+func (i sortedIndex) get(key string) (int64, bool, error) {
+	n := i.search(key)
+	if n < len(i) && i[n].key == key {
+		return i[n].offset, true, nil
+	}
+	return 0, false, nil
+}
+
+func (i sortedIndex) iterator(start string) (indexIterator, error) {
+	return &keySliceIterator{keys: i, pos: i.search(start)}, nil
+}
+
+func (i sortedIndex) close() error {
+	return nil
+}
+
+type keySliceIterator struct {
+	keys []sparseKey
+	pos  int
+}
+
+func (it *keySliceIterator) valid() bool        { return it.pos < len(it.keys) }
+func (it *keySliceIterator) current() sparseKey { return it.keys[it.pos] }
+func (it *keySliceIterator) err() error         { return nil }
+
+func (it *keySliceIterator) next() bool {
+	it.pos++
+	return it.valid()
+}
+
+func writeKeyRecord(out *bufio.Writer, k sparseKey) (int, error) {
+	buf := make([]byte, 12)
+	binary.LittleEndian.PutUint32(buf, uint32(len(k.key)))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(k.offset))
+	if _, err := out.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err := out.WriteString(k.key); err != nil {
+		return 0, err
+	}
+	return len(buf) + len(k.key), nil
+}
+
+func readKeyRecord(in *bufio.Reader) (sparseKey, int, error) {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		return sparseKey{}, 0, err
+	}
+	key := make([]byte, binary.LittleEndian.Uint32(buf))
+	if _, err := io.ReadFull(in, key); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return sparseKey{}, 0, err
+	}
+	return sparseKey{
+		key:    string(key),
+		offset: int64(binary.LittleEndian.Uint64(buf[4:])),
+	}, len(buf) + len(key), nil
+}
+
+// diskIndex keeps the full sorted key index of a segment in a file next
+// to it and only every indexSampleRate-th key in memory.
+type diskIndex struct {
+	path   string
+	file   File
+	size   int64
+	sample []sparseKey
+}
+
+// writeDiskIndex writes the index under a temporary name first, as an
+// index cut short by a crash could still parse and silently miss keys.
+func writeDiskIndex(fs FS, path string, index hashIndex) (*diskIndex, error) {
+	tmpPath := path + ".tmp"
+	f, err := createFile(fs, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(f)
+	for _, k := range index.sorted("") {
+		if _, err := writeKeyRecord(out, k); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := closeSynced(f); err != nil {
+		return nil, err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return openDiskIndex(fs, path)
+}
+
+func openDiskIndex(fs FS, path string) (*diskIndex, error) {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	idx := &diskIndex{path: path, file: f, size: info.Size()}
+	in := bufio.NewReader(f)
+	var offset int64
+	for i := 0; ; i++ {
+		k, n, err := readKeyRecord(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if i%indexSampleRate == 0 {
+			idx.sample = append(idx.sample, sparseKey{key: k.key, offset: offset})
+		}
+		offset += int64(n)
+	}
+	return idx, nil
+}
+
+func (idx *diskIndex) get(key string) (int64, bool, error) {
+	i := sort.Search(len(idx.sample), func(i int) bool { return idx.sample[i].key > key }) - 1
+	if i < 0 {
+		return 0, false, nil
+	}
+	from := idx.sample[i].offset
+	to := idx.size
+	if i+1 < len(idx.sample) {
+		to = idx.sample[i+1].offset
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(idx.file, from, to-from))
+	for {
+		k, _, err := readKeyRecord(in)
+		if err == io.EOF {
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		if k.key == key {
+			return k.offset, true, nil
+		}
+		if k.key > key {
+			return 0, false, nil
+		}
+	}
+}
+
+func (idx *diskIndex) iterator(start string) (indexIterator, error) {
+	var from int64
+	if i := sort.Search(len(idx.sample), func(i int) bool { return idx.sample[i].key > start }) - 1; i >= 0 {
+		from = idx.sample[i].offset
+	}
+	it := &diskIndexIterator{in: bufio.NewReader(io.NewSectionReader(idx.file, from, idx.size-from))}
+	it.next()
+	for it.valid() && it.current().key < start {
+		it.next()
+	}
+	return it, nil
+}
+
+// reopen returns the index on a file handle of its own, which stays
+// readable after idx is closed.
+func (idx *diskIndex) reopen(fs FS) (*diskIndex, error) {
+	f, err := openRead(fs, idx.path)
+	if err != nil {
+		return nil, err
+	}
+	return &diskIndex{path: idx.path, file: f, size: idx.size, sample: idx.sample}, nil
+}
+
+func (idx *diskIndex) close() error {
+	return idx.file.Close()
+}
+
+type diskIndexIterator struct {
+	in      *bufio.Reader
+	key     sparseKey
+	ok      bool
+	failure error
+}
+
+func (it *diskIndexIterator) valid() bool        { return it.ok }
+func (it *diskIndexIterator) current() sparseKey { return it.key }
+func (it *diskIndexIterator) err() error         { return it.failure }
+
+func (it *diskIndexIterator) next() bool {
+	k, _, err := readKeyRecord(it.in)
+	if err != nil {
+		if err != io.EOF {
+			it.failure = err
+		}
+		it.ok = false
+		return false
+	}
+	it.key = k
+	it.ok = true
+	return true
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDb_DiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 200, true, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 40; k++ {
+			err := db.Put(fmt.Sprintf("key%d", k), fmt.Sprintf("value%d-%d", k, i))
+			if err != nil {
+				t.Fatalf("Cannot put key%d: %s", k, err)
+			}
+		}
+	}
+	if err := db.PutInt64("number", 7); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, segment := range db.segments {
+		if _, ok := segment.index.(*diskIndex); !ok {
+			t.Errorf("Segment %s does not use a disk index", segment.outPath)
+		}
+	}
+	for k := 0; k < 40; k++ {
+		value, err := db.Get(fmt.Sprintf("key%d", k))
+		if err != nil {
+			t.Fatalf("Cannot get key%d: %s", k, err)
+		}
+		if value != fmt.Sprintf("value%d-2", k) {
+			t.Errorf("Bad value returned expected value%d-2, got %s", k, value)
+		}
+	}
+	if v, err := db.GetInt64("number"); err != nil || v != 7 {
+		t.Errorf("Bad int64 value %d (%v)", v, err)
+	}
+}
+
+func TestIndex_Iterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := make(hashIndex)
+	for i := 0; i < 3*indexSampleRate; i++ {
+		index[fmt.Sprintf("key%03d", i)] = int64(i)
+	}
+	disk, err := writeDiskIndex(orOSFS(nil), filepath.Join(dir, "segment"+indexFileSuffix), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.close()
+
+	for name, idx := range map[string]segmentIndex{"hash": index, "sorted": sortedIndex(index.sorted("")), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range []struct {
+				start string
+				first int
+			}{{"", 0}, {"key100", 100}, {"key1005", 101}, {"key191", 191}, {"zzz", len(index)}} {
+				it, err := idx.iterator(tc.start)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n := tc.first
+				for ; it.valid(); it.next() {
+					if k := it.current(); k.key != fmt.Sprintf("key%03d", n) || k.offset != int64(n) {
+						t.Fatalf("Expected key%03d from %q, got %+v", n, tc.start, k)
+					}
+					n++
+				}
+				if err := it.err(); err != nil || n != len(index) {
+					t.Errorf("Expected to end at %d from %q, got %d (%v)", len(index), tc.start, n, err)
+				}
+			}
+			if offset, ok, err := idx.get("key150"); !ok || offset != 150 || err != nil {
+				t.Errorf("Bad offset %d for key150 (%v, %v)", offset, ok, err)
+			}
+			if _, ok, _ := idx.get("key1500"); ok {
+				t.Error("Found a missing key")
+			}
+		})
+	}
+}
+
+func benchmarkDbGet(b *testing.B, opts ...Option) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	tempDir = dir
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keys = 20000
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	db, err := NewDb(currentFile, dir, 64*1024, false, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "heap-B/key")
+}
+
+func BenchmarkDb_GetMemoryIndex(b *testing.B) {
+	benchmarkDbGet(b)
+}
+
+func BenchmarkDb_GetDiskIndex(b *testing.B) {
+	benchmarkDbGet(b, WithDiskIndex())
+}
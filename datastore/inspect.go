@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RecordInfo describes one record of a data file as it is stored on disk.
+// Value holds the location of the value for records pointing to a value
+// log.
+type RecordInfo struct {
+	Offset    int64
+	Size      int
+	Key       string
+	Type      string
+	Value     string
+	Encrypted bool
+}
+
+// ReadRecords calls fn for every record of a segment, current or value log
+// file in file order. Offsets are positions in the uncompressed record
+// stream, the same ones indexes refer to.
+func ReadRecords(path string, fn func(r RecordInfo) error, opts ...Option) error {
+	keys, err := optionKeys(opts)
+	if err != nil {
+		return err
+	}
+	return readRecords(optionFS(opts), path, keys, func(data []byte, e entry, offset int64) error {
+		r := RecordInfo{
+			Offset:    offset,
+			Size:      len(data),
+			Key:       e.key,
+			Type:      e.valueType,
+			Value:     e.value,
+			Encrypted: isEncryptedRecord(data),
+		}
+		if isValuePointer(e.valueType) {
+			if p, err := decodeValuePointer(e.value); err == nil {
+				r.Value = p.String()
+			}
+		}
+		return fn(r)
+	})
+}
+
+// readRecords calls fn with the stored bytes and the decoded entry of every
+// record of a data file of any version.
+func readRecords(fs FS, path string, keys *keyring, fn func(data []byte, e entry, offset int64) error) error {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	read := func(in *bufio.Reader, offset int64) error {
+		for {
+			data, err := readRecord(in)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("record at %d: %w", offset, err)
+			}
+			e, err := keys.decode(data)
+			if err != nil {
+				return fmt.Errorf("record at %d: %w", offset, err)
+			}
+			if err := fn(data, e, offset); err != nil {
+				return err
+			}
+			offset += int64(len(data))
+		}
+	}
+
+	blocks, err := loadSegmentBlocks(fs, path)
+	if err != nil {
+		return err
+	}
+	if blocks == nil {
+		in := bufio.NewReader(f)
+		h, err := readFileHeader(in)
+		if err != nil {
+			return err
+		}
+		return read(in, h.size())
+	}
+	for _, b := range blocks {
+		data, err := readBlock(f, b)
+		if err != nil {
+			return err
+		}
+		if err := read(bufio.NewReader(bytes.NewReader(data)), b.rawOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStats summarizes the records of one file of a data directory. Live
+// bytes belong to records that still hold the latest value of their key,
+// dead bytes are what a merge would drop.
+type FileStats struct {
+	Name      string
+	Records   int
+	Keys      int
+	LiveBytes int64
+	DeadBytes int64
+	Types     map[string]int
+}
+
+// DirStats reads the sealed segments and the current file of a stopped
+// database in dir, oldest first.
+func DirStats(dir string, opts ...Option) ([]FileStats, error) {
+	m, err := readManifest(optionFS(opts), dir)
+	if os.IsNotExist(err) {
+		m = manifest{current: currentFile}
+	} else if err != nil {
+		return nil, err
+	}
+	names := append(append([]string(nil), m.segments...), m.current)
+
+	type location struct {
+		file int
+		size int
+	}
+	latest := make(map[string]location)
+	stats := make([]FileStats, len(names))
+	for i, name := range names {
+		stats[i] = FileStats{Name: name, Types: make(map[string]int)}
+		keys := make(map[string]bool)
+		err := ReadRecords(filepath.Join(dir, name), func(r RecordInfo) error {
+			stats[i].Records++
+			stats[i].Types[r.Type]++
+			keys[r.Key] = true
+			latest[r.Key] = location{file: i, size: r.Size}
+			stats[i].DeadBytes += int64(r.Size)
+			return nil
+		}, opts...)
+		if os.IsNotExist(err) && name == m.current {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		stats[i].Keys = len(keys)
+	}
+
+	for _, l := range latest {
+		stats[l.file].LiveBytes += int64(l.size)
+		stats[l.file].DeadBytes -= int64(l.size)
+	}
+	return stats, nil
+}
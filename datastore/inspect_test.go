@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, false, WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for k := 0; k < 20; k++ {
+			if err := db.Put(fmt.Sprintf("key%d", k), fmt.Sprintf("value%d-%d", k, i)); err != nil {
+				t.Fatalf("Cannot put key%d: %s", k, err)
+			}
+		}
+	}
+	if err := db.PutInt64("number", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("records", func(t *testing.T) {
+		var records []RecordInfo
+		err := ReadRecords(filepath.Join(dir, outFileName+"1"), func(r RecordInfo) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			t.Fatal("No records in the first segment")
+		}
+		if r := records[0]; r.Offset != fileHeaderSize || r.Key != "key0" || r.Type != "s" || r.Value != "value0-0" {
+			t.Errorf("Unexpected first record %+v", r)
+		}
+		if r := records[1]; r.Offset != records[0].Offset+int64(records[0].Size) {
+			t.Errorf("Unexpected offset %d of the second record", r.Offset)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := DirStats(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, keys, types := 0, 0, 0
+		var live int64
+		for _, s := range stats {
+			records += s.Records
+			keys += s.Keys
+			types += s.Types["i"]
+			live += s.LiveBytes
+		}
+		if records != 41 || types != 1 {
+			t.Errorf("Expected 41 records with one int64, got %d and %d", records, types)
+		}
+		if keys != 41 {
+			t.Errorf("Expected 41 keys over all files, got %d", keys)
+		}
+		if stats[0].LiveBytes != 0 || stats[0].DeadBytes == 0 {
+			t.Errorf("First segment should only hold dead records: %+v", stats[0])
+		}
+		if live == 0 {
+			t.Error("No live bytes")
+		}
+	})
+}
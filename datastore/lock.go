@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// lockFileName is the file a process holds an exclusive lock on while it
+// has the directory open. The operating system drops the lock when the
+// process dies, so a crash never leaves the directory locked.
+const lockFileName = "LOCK"
+
+var ErrLocked = fmt.Errorf("data directory is in use by another process")
+
+type dirLock struct {
+	file io.Closer
+}
+
+// lockDir takes the lock of a data directory or fails with ErrLocked if
+// another Db, in this or another process, holds it.
+func lockDir(fs FS, dir string) (*dirLock, error) {
+	f, err := fs.Lock(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &dirLock{file: f}, nil
+}
+
+func (l *dirLock) unlock() error {
+	return l.file.Close()
+}
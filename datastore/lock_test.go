@@ -0,0 +1,40 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(currentFile, dir, 300, false); err != ErrLocked {
+		t.Errorf("Expected ErrLocked for a second Db, got %v", err)
+	}
+	if _, err := NewLsmDb(dir, 1000); err != ErrLocked {
+		t.Errorf("Expected ErrLocked for an LsmDb, got %v", err)
+	}
+	if _, err := Check(dir); err != ErrLocked {
+		t.Errorf("Expected ErrLocked for Check, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(currentFile, dir, 300, false)
+	if err != nil {
+		t.Fatalf("Cannot open the directory after Close: %s", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,620 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	lsmWalFile      = "lsm-wal"
+	lsmManifestFile = "lsm-manifest"
+	lsmTablePrefix  = "table-"
+
+	lsmMaxLevels     = 7
+	lsmL0Limit       = 4
+	lsmLevelMultiple = 10
+)
+
+// memtable keeps the most recent writes sorted by key until it grows
+// past the configured size and is flushed into a level 0 table.
+type memtable struct {
+	entries []entry
+	size    int
+}
+
+func (m *memtable) put(e entry) {
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].key >= e.key })
+	if i < len(m.entries) && m.entries[i].key == e.key {
+		m.size += len(e.Encode()) - len(m.entries[i].Encode())
+		m.entries[i] = e
+		return
+	}
+	m.entries = append(m.entries, entry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = e
+	m.size += len(e.Encode())
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].key >= key })
+	if i < len(m.entries) && m.entries[i].key == key {
+		return m.entries[i], true
+	}
+	return entry{}, false
+}
+
+func (m *memtable) iterator(start string) *sliceIterator {
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].key >= start })
+	return &sliceIterator{entries: m.entries, pos: i}
+}
+
+// LsmDb is a leveled log-structured merge tree offering the same API as
+// Db. Only the memtable is kept in memory; sealed data lives in sorted
+// tables with sparse indexes, and levels are compacted in the background.
+type LsmDb struct {
+	mu           sync.RWMutex
+	fs           FS
+	dir          string
+	memtableSize int
+	wal          File
+	mem          *memtable
+	levels       [lsmMaxLevels][]*table
+	nextTable    int
+	compact      chan bool
+	done         chan bool
+	lock         *dirLock
+	closed       bool
+}
+
+func NewLsmDb(dir string, memtableSize int) (*LsmDb, error) {
+	fs := osFS{}
+	lock, err := lockDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	db := &LsmDb{
+		fs:           fs,
+		dir:          dir,
+		memtableSize: memtableSize,
+		mem:          new(memtable),
+		compact:      make(chan bool, 1),
+		done:         make(chan bool),
+		lock:         lock,
+	}
+	if err := db.loadManifest(); err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	walSize, err := db.replayWal()
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	wal, err := fs.OpenFile(filepath.Join(dir, lsmWalFile), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	if err := wal.Truncate(walSize); err != nil {
+		wal.Close()
+		lock.unlock()
+		return nil, err
+	}
+	db.wal = wal
+
+	go func() {
+		for range db.compact {
+			if err := db.runCompaction(); err != nil {
+				fmt.Println(err)
+			}
+		}
+		close(db.done)
+	}()
+
+	return db, nil
+}
+
+func (db *LsmDb) loadManifest() error {
+	data, err := readFile(db.fs, filepath.Join(db.dir, lsmManifestFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] == "next" {
+			db.nextTable, err = strconv.Atoi(fields[1])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		level, err := strconv.Atoi(fields[0])
+		if err != nil || level < 0 || level >= lsmMaxLevels {
+			return fmt.Errorf("bad manifest line %q", line)
+		}
+		t, err := openTable(db.fs, filepath.Join(db.dir, fields[1]))
+		if err != nil {
+			return err
+		}
+		db.levels[level] = append(db.levels[level], t)
+	}
+	return nil
+}
+
+func (db *LsmDb) saveManifest() error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "next %d\n", db.nextTable)
+	for level, tables := range db.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&b, "%d %s\n", level, filepath.Base(t.path))
+		}
+	}
+
+	tmp := filepath.Join(db.dir, lsmManifestFile+".tmp")
+	if err := writeFile(db.fs, tmp, []byte(b.String())); err != nil {
+		return err
+	}
+	return db.fs.Rename(tmp, filepath.Join(db.dir, lsmManifestFile))
+}
+
+// replayWal fills the memtable from the write-ahead log and returns the
+// length of its complete records. A record cut short at the end is what a
+// crash during a write leaves; the log is truncated to drop it, as new
+// records appended after it would not be read back.
+func (db *LsmDb) replayWal() (int64, error) {
+	path := filepath.Join(db.dir, lsmWalFile)
+	input, err := openRead(db.fs, path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	in := bufio.NewReader(input)
+	var size int64
+	for {
+		e, n, err := readEntry(in)
+		if err == io.EOF {
+			return size, nil
+		} else if err == io.ErrUnexpectedEOF {
+			log.Printf("Dropping incomplete record at %d of %s", size, path)
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		db.mem.put(e)
+		size += int64(n)
+	}
+}
+
+func (db *LsmDb) newTablePath() string {
+	db.nextTable++
+	return filepath.Join(db.dir, lsmTablePrefix+strconv.Itoa(db.nextTable))
+}
+
+func (db *LsmDb) put(e entry) error {
+	if err := checkSize(e); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	if _, err := db.wal.Write(e.Encode()); err != nil {
+		return err
+	}
+	db.mem.put(e)
+	if db.mem.size < db.memtableSize {
+		return nil
+	}
+	return db.flush()
+}
+
+func (db *LsmDb) flush() error {
+	if len(db.mem.entries) == 0 {
+		return nil
+	}
+	t, err := writeTable(db.fs, db.newTablePath(), db.mem.entries)
+	if err != nil {
+		return err
+	}
+	db.levels[0] = append(db.levels[0], t)
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+
+	db.mem = new(memtable)
+	if err := db.wal.Close(); err != nil {
+		return err
+	}
+	wal, err := createFile(db.fs, filepath.Join(db.dir, lsmWalFile))
+	if err != nil {
+		return err
+	}
+	db.wal = wal
+
+	if len(db.levels[0]) >= lsmL0Limit {
+		select {
+		case db.compact <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+func (db *LsmDb) levelLimit(level int) int64 {
+	limit := int64(db.memtableSize) * lsmLevelMultiple
+	for i := 1; i < level; i++ {
+		limit *= lsmLevelMultiple
+	}
+	return limit
+}
+
+func levelSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// runCompaction merges level 0 into level 1 and then pushes every level
+// that exceeds its size limit one level down, until all levels fit.
+func (db *LsmDb) runCompaction() error {
+	db.mu.RLock()
+	l0 := len(db.levels[0])
+	db.mu.RUnlock()
+	if l0 >= lsmL0Limit {
+		if err := db.compactLevel(0); err != nil {
+			return err
+		}
+	}
+
+	for level := 1; level < lsmMaxLevels-1; level++ {
+		// Every pass moves one table down, so the level shrinks each time.
+		for {
+			db.mu.RLock()
+			size := levelSize(db.levels[level])
+			db.mu.RUnlock()
+			if size <= db.levelLimit(level) {
+				break
+			}
+			if err := db.compactLevel(level); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactLevel merges tables of the given level with the overlapping
+// tables of the next one. Level 0 tables may overlap each other, so all
+// of them are taken at once; for deeper levels the first table is moved.
+func (db *LsmDb) compactLevel(level int) error {
+	db.mu.RLock()
+	var inputs []*table
+	if level == 0 {
+		for i := len(db.levels[0]) - 1; i >= 0; i-- {
+			inputs = append(inputs, db.levels[0][i])
+		}
+	} else {
+		inputs = append(inputs, db.levels[level][0])
+	}
+	start, end := inputs[0].minKey(), inputs[0].maxKey()
+	for _, t := range inputs {
+		if t.minKey() < start {
+			start = t.minKey()
+		}
+		if t.maxKey() > end {
+			end = t.maxKey()
+		}
+	}
+	var overlapping []*table
+	for _, t := range db.levels[level+1] {
+		if t.maxKey() >= start && t.minKey() <= end {
+			overlapping = append(overlapping, t)
+		}
+	}
+	// Tombstones are kept while a deeper level may hold older values.
+	bottom := true
+	for l := level + 2; l < lsmMaxLevels; l++ {
+		if len(db.levels[l]) > 0 {
+			bottom = false
+		}
+	}
+	db.mu.RUnlock()
+
+	var sources []entryIterator
+	for _, t := range append(inputs, overlapping...) {
+		sources = append(sources, t.iterator(""))
+	}
+	it := newMergeIterator(sources)
+
+	var (
+		outputs []*table
+		block   []entry
+		size    int
+	)
+	writeBlock := func() error {
+		db.mu.Lock()
+		path := db.newTablePath()
+		db.mu.Unlock()
+		t, err := writeTable(db.fs, path, block)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		block, size = nil, 0
+		return nil
+	}
+	for ; it.valid(); it.next() {
+		e := it.entry()
+		if bottom && e.valueType == tombstoneType {
+			continue
+		}
+		block = append(block, e)
+		size += len(e.Encode())
+		if size >= db.memtableSize {
+			if err := writeBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		return err
+	}
+	if len(block) > 0 {
+		if err := writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.levels[level] = removeTables(db.levels[level], inputs)
+	next := append(removeTables(db.levels[level+1], overlapping), outputs...)
+	sort.Slice(next, func(i, j int) bool { return next[i].minKey() < next[j].minKey() })
+	db.levels[level+1] = next
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+
+	for _, t := range append(inputs, overlapping...) {
+		t.close()
+		db.fs.Remove(t.path)
+	}
+	return nil
+}
+
+func removeTables(tables, removed []*table) []*table {
+	var res []*table
+	for _, t := range tables {
+		keep := true
+		for _, r := range removed {
+			if t == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func (db *LsmDb) get(key string) (entry, error) {
+	if e, ok := db.mem.get(key); ok {
+		return e, nil
+	}
+	for i := len(db.levels[0]) - 1; i >= 0; i-- {
+		e, ok, err := db.levels[0][i].get(key)
+		if err != nil {
+			return entry{}, err
+		}
+		if ok {
+			return e, nil
+		}
+	}
+	for level := 1; level < lsmMaxLevels; level++ {
+		tables := db.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].maxKey() >= key })
+		if i == len(tables) {
+			continue
+		}
+		e, ok, err := tables[i].get(key)
+		if err != nil {
+			return entry{}, err
+		}
+		if ok {
+			return e, nil
+		}
+	}
+	return entry{}, ErrNotFound
+}
+
+// getLive is get that reports deleted keys as missing.
+func (db *LsmDb) getLive(key string) (entry, error) {
+	e, err := db.get(key)
+	if err == nil && e.valueType == tombstoneType {
+		return entry{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (db *LsmDb) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *LsmDb) GetInt64(key string) (int64, error) {
+	return db.GetInt64Context(context.Background(), key)
+}
+
+func (db *LsmDb) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+func (db *LsmDb) PutInt64(key string, value int64) error {
+	return db.PutInt64Context(context.Background(), key, value)
+}
+
+// GetContext is Get that fails with the context error if ctx is already
+// done. LsmDb has no write queue, so there is nothing to wait for.
+func (db *LsmDb) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, err := db.getLive(key)
+	if err != nil {
+		return "", err
+	}
+	if e.valueType != "s" {
+		return "", ErrWrongDataType
+	}
+	return e.value, nil
+}
+
+func (db *LsmDb) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, err := db.getLive(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.valueType != "i" {
+		return 0, ErrWrongDataType
+	}
+
+	value, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, ErrWrongDataType
+	}
+	return value, nil
+}
+
+func (db *LsmDb) PutContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.put(entry{
+		key:       key,
+		valueType: "s",
+		value:     value,
+	})
+}
+
+func (db *LsmDb) PutInt64Context(ctx context.Context, key string, value int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.put(entry{
+		key:       key,
+		valueType: "i",
+		value:     strconv.FormatInt(value, 10),
+	})
+}
+
+// Scan calls fn for every key in [start, end) in ascending order. An empty
+// end means no upper bound. Scanning stops at the first error returned by fn.
+func (db *LsmDb) Scan(start, end string, fn func(key, value string) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	sources := []entryIterator{db.mem.iterator(start)}
+	for i := len(db.levels[0]) - 1; i >= 0; i-- {
+		if db.levels[0][i].overlaps(start, end) {
+			sources = append(sources, db.levels[0][i].iterator(start))
+		}
+	}
+	for level := 1; level < lsmMaxLevels; level++ {
+		for _, t := range db.levels[level] {
+			if t.overlaps(start, end) {
+				sources = append(sources, t.iterator(start))
+			}
+		}
+	}
+
+	it := newMergeIterator(sources)
+	for ; it.valid(); it.next() {
+		e := it.entry()
+		if end != "" && e.key >= end {
+			break
+		}
+		if e.valueType == tombstoneType {
+			continue
+		}
+		if err := fn(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return it.err()
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (db *LsmDb) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *LsmDb) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.put(entry{key: key, valueType: tombstoneType})
+}
+
+// Close flushes the memtable and stops compactions. Calls after the first
+// one do nothing.
+func (db *LsmDb) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	err := db.flush()
+	if err == nil {
+		db.closed = true
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	close(db.compact)
+	<-db.done
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+	if err := db.wal.Close(); err != nil {
+		return err
+	}
+	return db.lock.unlock()
+}
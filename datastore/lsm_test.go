@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLsmDb_PutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i%100)
+			if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatalf("Cannot put %s: %s", key, err)
+			}
+		}
+		if err := db.PutInt64("counter", 42); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 200; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i%100)
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value returned expected value%d, got %s", i, value)
+			}
+		}
+		if v, err := db.GetInt64("counter"); err != nil || v != 42 {
+			t.Errorf("Bad int64 value %d (%v)", v, err)
+		}
+		if _, err := db.Get("counter"); err != ErrWrongDataType {
+			t.Errorf("Expected wrong data type error, got %v", err)
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected not found error, got %v", err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		var keys []string
+		err := db.Scan("key010", "key020", func(key, value string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 10 || keys[0] != "key010" || keys[9] != "key019" {
+			t.Errorf("Unexpected scan result %v", keys)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewLsmDb(dir, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		deeper := 0
+		for level := 1; level < lsmMaxLevels; level++ {
+			deeper += len(db.levels[level])
+		}
+		if deeper == 0 {
+			t.Errorf("Expected compaction into deeper levels")
+		}
+
+		for i := 200; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i%100)
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value returned expected value%d, got %s", i, value)
+			}
+		}
+	})
+}
+
+func TestLsmDb_TornWal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	complete := (&entry{key: "key", valueType: "s", value: "value"}).Encode()
+	torn := (&entry{key: "torn", valueType: "s", value: "value"}).Encode()
+	wal := append(append([]byte(nil), complete...), torn[:len(torn)-3]...)
+	if err := ioutil.WriteFile(filepath.Join(dir, lsmWalFile), wal, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewLsmDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, lsmWalFile)); err != nil {
+		t.Error(err)
+	} else if info.Size() != int64(len(complete)) {
+		t.Errorf("Expected the log truncated to %d bytes, got %d", len(complete), info.Size())
+	}
+	if v, err := db.Get("key"); err != nil || v != "value" {
+		t.Errorf("Bad value %q (%v)", v, err)
+	}
+	if _, err := db.Get("torn"); err != ErrNotFound {
+		t.Errorf("Expected the torn record to be dropped, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Expected a second Close to do nothing, got %v", err)
+	}
+	if err := db.Put("key", "closed"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const manifestFile = "manifest"
+
+// manifest lists the files making up a Db: the current file and the
+// sealed segments, oldest first, plus the last segment number used and
+// the generation of the current file, which change sequences start with.
+// Segments may come with their key and live byte counts for Stats.
+// Backups also list value log files and the checkpoints they cover.
+type manifest struct {
+	current    string
+	next       int
+	generation int
+	segments   []string
+	usage      map[string]fileUsage
+	valueLogs  []string
+	checkpoint Checkpoint
+	since      Checkpoint
+}
+
+func (m manifest) encode() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "current %s\n", m.current)
+	fmt.Fprintf(&b, "next %d\n", m.next)
+	if m.generation > 0 {
+		fmt.Fprintf(&b, "generation %d\n", m.generation)
+	}
+	for _, name := range m.segments {
+		if u, ok := m.usage[name]; ok {
+			fmt.Fprintf(&b, "segment %s %d %d\n", name, u.keys, u.live)
+		} else {
+			fmt.Fprintf(&b, "segment %s\n", name)
+		}
+	}
+	for _, name := range m.valueLogs {
+		fmt.Fprintf(&b, "valuelog %s\n", name)
+	}
+	if m.checkpoint != (Checkpoint{}) {
+		fmt.Fprintf(&b, "checkpoint %s\n", m.checkpoint)
+	}
+	if m.since != (Checkpoint{}) {
+		fmt.Fprintf(&b, "since %s\n", m.since)
+	}
+	return b.Bytes()
+}
+
+func decodeManifest(data []byte) (manifest, error) {
+	var m manifest
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && (fields[0] != "segment" || len(fields) != 4) {
+			return manifest{}, fmt.Errorf("bad manifest line %q", line)
+		}
+
+		var err error
+		switch fields[0] {
+		case "current":
+			m.current = fields[1]
+		case "next":
+			m.next, err = strconv.Atoi(fields[1])
+		case "generation":
+			m.generation, err = strconv.Atoi(fields[1])
+		case "segment":
+			m.segments = append(m.segments, fields[1])
+			if len(fields) == 4 {
+				var u fileUsage
+				if u.keys, err = strconv.Atoi(fields[2]); err == nil {
+					u.live, err = strconv.ParseInt(fields[3], 10, 64)
+				}
+				if m.usage == nil {
+					m.usage = make(map[string]fileUsage)
+				}
+				m.usage[fields[1]] = u
+			}
+		case "valuelog":
+			m.valueLogs = append(m.valueLogs, fields[1])
+		case "checkpoint":
+			m.checkpoint, err = ParseCheckpoint(fields[1])
+		case "since":
+			m.since, err = ParseCheckpoint(fields[1])
+		default:
+			err = fmt.Errorf("unknown entry")
+		}
+		if err != nil {
+			return manifest{}, fmt.Errorf("bad manifest line %q: %s", line, err)
+		}
+	}
+	return m, nil
+}
+
+func readManifest(fs FS, dir string) (manifest, error) {
+	data, err := readFile(fs, filepath.Join(dir, manifestFile))
+	if err != nil {
+		return manifest{}, err
+	}
+	return decodeManifest(data)
+}
+
+func (db *Db) manifest() manifest {
+	m := manifest{
+		current:    db.currentName,
+		next:       db.nextSegment,
+		generation: db.generation,
+		usage:      make(map[string]fileUsage),
+	}
+	for _, seg := range db.segments {
+		name := filepath.Base(seg.outPath)
+		m.segments = append(m.segments, name)
+		m.usage[name] = seg.usage
+	}
+	return m
+}
+
+// saveManifest records the live segments, so that a restarted Db or a
+// restored backup knows what to load.
+func (db *Db) saveManifest() error {
+	return writeManifest(db.fs, db.dir, db.manifest())
+}
+
+// writeManifest replaces the manifest of dir. Once it returns, the new
+// manifest and the files renamed into dir before it survive a crash, so
+// the files it no longer lists can be removed.
+func writeManifest(fs FS, dir string, m manifest) error {
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	if err := writeFile(fs, tmp, m.encode()); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, filepath.Join(dir, manifestFile)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// adoptSegments appends to m the segments numbered right after m.next. A
+// rollover or merge seals them before it saves the manifest, so a crash in
+// between leaves them unlisted; as numbers are never reused, they can only
+// be newer than the listed ones. The records of the current file may have
+// gone into them, so the next current file gets a generation of its own.
+func adoptSegments(fs FS, dir string, m *manifest) ([]string, error) {
+	var adopted []string
+	for {
+		name := outFileName + strconv.Itoa(m.next+1)
+		if _, err := fs.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			if len(adopted) > 0 {
+				m.generation++
+			}
+			return adopted, nil
+		} else if err != nil {
+			return adopted, err
+		}
+		m.segments = append(m.segments, name)
+		m.next++
+		adopted = append(adopted, name)
+	}
+}
+
+// loadSegments opens the sealed segments listed in the manifest, and those
+// a crash kept out of it, and rebuilds their indexes.
+func (db *Db) loadSegments() error {
+	m, err := readManifest(db.fs, db.dir)
+	if os.IsNotExist(err) {
+		m = manifest{}
+	} else if err != nil {
+		return err
+	}
+	adopted, err := adoptSegments(db.fs, db.dir, &m)
+	if err != nil {
+		return err
+	}
+	db.generation = m.generation
+	db.nextSegment = m.next
+	for _, name := range m.segments {
+		seg := Segment{outPath: filepath.Join(db.dir, name)}
+		seg.blocks, err = loadSegmentBlocks(db.fs, seg.outPath)
+		if err != nil {
+			return err
+		}
+
+		u, counted := m.usage[name]
+		if db.diskIndex && counted {
+			if idx, err := openDiskIndex(db.fs, seg.outPath+indexFileSuffix); err == nil {
+				seg.index = idx
+				seg.usage = u
+				seg.outOffset, err = segmentRawSize(db.fs, &seg)
+				if err != nil {
+					return err
+				}
+				db.segments = append(db.segments, seg)
+				continue
+			}
+		}
+
+		index := make(hashIndex)
+		var sizes usage
+		seg.outOffset, err = db.scanSegment(&seg, func(e entry, offset int64, size int) error {
+			index[e.key] = offset
+			sizes.record(e, size)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		seg.usage = sizes.total()
+		if err := db.sealIndex(&seg, index); err != nil {
+			return err
+		}
+		db.segments = append(db.segments, seg)
+	}
+	if len(adopted) > 0 || (db.diskIndex && len(m.usage) < len(m.segments)) {
+		return db.saveManifest()
+	}
+	return nil
+}
+
+func segmentRawSize(fs FS, seg *Segment) (int64, error) {
+	if seg.blocks != nil {
+		last := seg.blocks[len(seg.blocks)-1]
+		return last.rawOffset + int64(last.rawSize), nil
+	}
+	info, err := fs.Stat(seg.outPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// scanSegment calls fn for every record of a sealed segment in file order
+// and returns the size of the uncompressed record stream.
+func (db *Db) scanSegment(seg *Segment, fn func(e entry, offset int64, size int) error) (int64, error) {
+	f, err := openRead(db.fs, seg.outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan := func(in *bufio.Reader, offset int64) (int64, error) {
+		for {
+			e, n, err := db.keys.readEntry(in)
+			if err == io.EOF {
+				return offset, nil
+			} else if err != nil {
+				return offset, err
+			}
+			if err := fn(e, offset, n); err != nil {
+				return offset, err
+			}
+			offset += int64(n)
+		}
+	}
+
+	if seg.blocks == nil {
+		in := bufio.NewReader(f)
+		h, err := readFileHeader(in)
+		if err != nil {
+			return 0, err
+		}
+		return scan(in, h.size())
+	}
+	var size int64
+	for _, b := range seg.blocks {
+		data, err := readBlock(f, b)
+		if err != nil {
+			return size, err
+		}
+		size, err = scan(bufio.NewReader(bytes.NewReader(data)), b.rawOffset)
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
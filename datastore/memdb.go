@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemDb keeps all keys in memory and nothing on disk. It suits tests and
+// caches that may lose their data on restart.
+type MemDb struct {
+	mu     sync.RWMutex
+	data   map[string]entry
+	closed bool
+}
+
+func NewMemDb() *MemDb {
+	return &MemDb{data: make(map[string]entry)}
+}
+
+func (db *MemDb) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *MemDb) GetInt64(key string) (int64, error) {
+	return db.GetInt64Context(context.Background(), key)
+}
+
+func (db *MemDb) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+func (db *MemDb) PutInt64(key string, value int64) error {
+	return db.PutInt64Context(context.Background(), key, value)
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (db *MemDb) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *MemDb) GetContext(ctx context.Context, key string) (string, error) {
+	e, err := db.get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if e.valueType != "s" {
+		return "", ErrWrongDataType
+	}
+	return e.value, nil
+}
+
+func (db *MemDb) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	e, err := db.get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if e.valueType != "i" {
+		return 0, ErrWrongDataType
+	}
+	return strconv.ParseInt(e.value, 10, 64)
+}
+
+func (db *MemDb) PutContext(ctx context.Context, key, value string) error {
+	return db.put(ctx, entry{key: key, valueType: "s", value: value})
+}
+
+func (db *MemDb) PutInt64Context(ctx context.Context, key string, value int64) error {
+	return db.put(ctx, entry{key: key, valueType: "i", value: strconv.FormatInt(value, 10)})
+}
+
+func (db *MemDb) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	delete(db.data, key)
+	return nil
+}
+
+// Scan calls fn for every key in [start, end) in ascending order. An empty
+// end means no upper bound. Scanning stops at the first error returned by fn.
+func (db *MemDb) Scan(start, end string, fn func(key, value string) error) error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrClosed
+	}
+	var entries []entry
+	for key, e := range db.data {
+		if key >= start && (end == "" || key < end) {
+			entries = append(entries, e)
+		}
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	for _, e := range entries {
+		if err := fn(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close drops the data. Later calls to other methods fail with ErrClosed.
+func (db *MemDb) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	db.data = nil
+	return nil
+}
+
+func (db *MemDb) get(ctx context.Context, key string) (entry, error) {
+	if err := ctx.Err(); err != nil {
+		return entry{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return entry{}, ErrClosed
+	}
+	e, ok := db.data[key]
+	if !ok {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (db *MemDb) put(ctx context.Context, e entry) error {
+	if err := checkSize(e); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.data[e.key] = e
+	return nil
+}
@@ -0,0 +1,342 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS held in memory. Open files keep their data after the
+// name is removed or renamed, as on Unix.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+type memData struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, string(filepath.Separator): true},
+		locks: make(map[string]bool),
+	}
+}
+
+func (fs *MemFS) pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[name]
+	switch {
+	case fs.dirs[name]:
+		return nil, fs.pathError("open", name, os.ErrInvalid)
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, fs.pathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, fs.pathError("open", name, os.ErrNotExist)
+	case !ok && !fs.dirs[filepath.Dir(name)]:
+		return nil, fs.pathError("open", name, os.ErrNotExist)
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, data: d, flag: flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	d, ok := fs.files[name]
+	if !ok {
+		return nil, fs.pathError("stat", name, os.ErrNotExist)
+	}
+	return d.info(name), nil
+}
+
+func (fs *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[name] {
+		return nil, fs.pathError("open", name, os.ErrNotExist)
+	}
+	var infos []os.FileInfo
+	for path, d := range fs.files {
+		if filepath.Dir(path) == name {
+			infos = append(infos, d.info(path))
+		}
+	}
+	for path := range fs.dirs {
+		if path != name && filepath.Dir(path) == name {
+			infos = append(infos, memFileInfo{name: filepath.Base(path), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for path := name; !fs.dirs[path]; path = filepath.Dir(path) {
+		if _, ok := fs.files[path]; ok {
+			return fs.pathError("mkdir", path, os.ErrExist)
+		}
+		fs.dirs[path] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if fs.dirs[newName] || !fs.dirs[filepath.Dir(newName)] {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	delete(fs.files, oldName)
+	fs.files[newName] = d
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if !fs.dirs[name] {
+		return fs.pathError("remove", name, os.ErrNotExist)
+	}
+	for path := range fs.files {
+		if strings.HasPrefix(path, name+string(filepath.Separator)) {
+			return fs.pathError("remove", name, os.ErrExist)
+		}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	prefix := name + string(filepath.Separator)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for path := range fs.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(fs.files, path)
+		}
+	}
+	for path := range fs.dirs {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(fs.dirs, path)
+		}
+	}
+	return nil
+}
+
+// SyncDir does nothing: the files of a MemFS are as durable as they get.
+func (fs *MemFS) SyncDir(name string) error {
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+func (d *memData) info(path string) os.FileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memFileInfo{name: filepath.Base(path), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0o700
+	}
+	return 0o600
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 || !write && f.flag&os.O_WRONLY != 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.data.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	copy(f.data.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.data.mu.Lock()
+		offset += int64(len(f.data.data))
+		f.data.mu.Unlock()
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return f.data.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check(true); err != nil {
+		return err
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, size-int64(len(f.data.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
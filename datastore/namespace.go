@@ -0,0 +1,302 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrBadNamespace = fmt.Errorf("namespace names must be non-empty and contain no NUL or slash")
+var ErrReservedKey = fmt.Errorf("keys starting with NUL are reserved for namespaces")
+
+var errStopScan = fmt.Errorf("scan limit reached")
+
+// namespaceMark starts the keys of every namespace. Namespaced keys are
+// stored as "\x00name\x00key" in the same store as all other keys, so
+// they sort before them and one range holds each namespace.
+const namespaceMark = "\x00"
+
+// NamespaceKey returns the key under which a store keeps key of namespace
+// name. Backups, exports and replication carry these keys as they are.
+func NamespaceKey(name, key string) string {
+	return namespaceMark + name + namespaceMark + key
+}
+
+// SplitNamespaceKey is the reverse of NamespaceKey. It reports false for
+// plain keys.
+func SplitNamespaceKey(key string) (name, nsKey string, ok bool) {
+	parts := strings.SplitN(key, namespaceMark, 3)
+	if len(parts) != 3 || parts[0] != "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// reservedKey reports whether key could pass for a key of a namespace,
+// which a Db does not take as a plain key.
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, namespaceMark)
+}
+
+// Namespace is a keyspace of its own inside a Store: its keys never
+// collide with the keys of other namespaces or with plain keys. Any Store
+// can hold namespaces, and writes to them go wherever the store writes.
+type Namespace struct {
+	store  Store
+	name   string
+	prefix string
+}
+
+var _ Store = (*Namespace)(nil)
+
+// NewNamespace returns namespace name of s. Namespaces need not be
+// created: one exists as long as it has keys.
+func NewNamespace(s Store, name string) (*Namespace, error) {
+	if name == "" || strings.ContainsAny(name, namespaceMark+"/") {
+		return nil, ErrBadNamespace
+	}
+	return &Namespace{store: s, name: name, prefix: NamespaceKey(name, "")}, nil
+}
+
+// Namespace returns namespace name of the Db.
+func (db *Db) Namespace(name string) (*Namespace, error) {
+	return NewNamespace(db, name)
+}
+
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+func (n *Namespace) Get(key string) (string, error) {
+	return n.store.Get(n.prefix + key)
+}
+
+func (n *Namespace) GetInt64(key string) (int64, error) {
+	return n.store.GetInt64(n.prefix + key)
+}
+
+func (n *Namespace) Put(key, value string) error {
+	return n.PutContext(context.Background(), key, value)
+}
+
+func (n *Namespace) PutInt64(key string, value int64) error {
+	return n.PutInt64Context(context.Background(), key, value)
+}
+
+func (n *Namespace) Delete(key string) error {
+	return n.DeleteContext(context.Background(), key)
+}
+
+func (n *Namespace) GetContext(ctx context.Context, key string) (string, error) {
+	return n.store.GetContext(ctx, n.prefix+key)
+}
+
+func (n *Namespace) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	return n.store.GetInt64Context(ctx, n.prefix+key)
+}
+
+// PutContext and the other writes go around the methods of a Db, which
+// reject keys that start with namespaceMark.
+func (n *Namespace) PutContext(ctx context.Context, key, value string) error {
+	if db, ok := n.store.(*Db); ok {
+		return db.write(ctx, entry{key: n.prefix + key, valueType: "s", value: value})
+	}
+	return n.store.PutContext(ctx, n.prefix+key, value)
+}
+
+func (n *Namespace) PutInt64Context(ctx context.Context, key string, value int64) error {
+	if db, ok := n.store.(*Db); ok {
+		return db.write(ctx, entry{key: n.prefix + key, valueType: "i", value: strconv.FormatInt(value, 10)})
+	}
+	return n.store.PutInt64Context(ctx, n.prefix+key, value)
+}
+
+func (n *Namespace) DeleteContext(ctx context.Context, key string) error {
+	if db, ok := n.store.(*Db); ok {
+		return db.write(ctx, entry{key: n.prefix + key, valueType: tombstoneType})
+	}
+	return n.store.DeleteContext(ctx, n.prefix+key)
+}
+
+// bounds turns [start, end) of the namespace into the range of the store.
+func (n *Namespace) bounds(start, end string) (string, string) {
+	if end == "" {
+		// The first key after every key of the namespace.
+		return n.prefix + start, n.prefix[:len(n.prefix)-1] + "\x01"
+	}
+	return n.prefix + start, n.prefix + end
+}
+
+// Scan calls fn for the keys of the namespace in [start, end), without
+// the namespace prefix.
+func (n *Namespace) Scan(start, end string, fn func(key, value string) error) error {
+	start, end = n.bounds(start, end)
+	return n.store.Scan(start, end, func(key, value string) error {
+		return fn(strings.TrimPrefix(key, n.prefix), value)
+	})
+}
+
+// ExportRange is Db.ExportRange for the keys of the namespace, written
+// without the namespace prefix. The store must be able to export ranges.
+func (n *Namespace) ExportRange(w io.Writer, start, end string, limit int) error {
+	e, ok := n.store.(interface {
+		ExportRange(w io.Writer, start, end string, limit int) error
+	})
+	if !ok {
+		return fmt.Errorf("%T cannot export ranges", n.store)
+	}
+	start, end = n.bounds(start, end)
+	out := &trimKeyWriter{w: w, prefix: n.prefix}
+	if err := e.ExportRange(out, start, end, limit); err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+// QueryIndex is Db.QueryIndex for the keys of the namespace, returned
+// without the namespace prefix. The store must have secondary indexes.
+func (n *Namespace) QueryIndex(name, value string) ([]string, error) {
+	q, ok := n.store.(interface {
+		QueryIndex(name, value string) ([]string, error)
+	})
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	all, err := q.QueryIndex(name, value)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(all))
+	for _, key := range all {
+		if strings.HasPrefix(key, n.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, n.prefix))
+		}
+	}
+	return keys, nil
+}
+
+// Close does nothing: the store stays open for other namespaces.
+func (n *Namespace) Close() error {
+	return nil
+}
+
+// Drop deletes every key of the namespace, a batch of keys at a time.
+func (n *Namespace) Drop(ctx context.Context) error {
+	start := ""
+	for {
+		var keys []string
+		err := n.Scan(start, "", func(key, value string) error {
+			if len(keys) == importBatchSize {
+				return errStopScan
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		start = keys[len(keys)-1] + "\x00"
+
+		if db, ok := n.store.(*Db); ok {
+			batch := make([]entry, len(keys))
+			for i, key := range keys {
+				batch[i] = entry{key: n.prefix + key, valueType: tombstoneType}
+			}
+			if err := db.send(ctx, entryWithResp{batch: batch, response: make(chan error, 1)}); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, key := range keys {
+			if err := n.DeleteContext(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NamespaceStats counts the keys of a namespace and the bytes of their
+// keys and values.
+type NamespaceStats struct {
+	Name  string `json:"name"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Stats reads every key of the namespace to count them.
+func (n *Namespace) Stats() (NamespaceStats, error) {
+	stats := NamespaceStats{Name: n.name}
+	err := n.Scan("", "", func(key, value string) error {
+		stats.Keys++
+		stats.Bytes += int64(len(key) + len(value))
+		return nil
+	})
+	return stats, err
+}
+
+// Namespaces returns the stats of every namespace of s with keys, sorted
+// by name: NUL sorts first, so the keys of a namespace come before those
+// of any longer name it starts. It reads all namespaced keys.
+func Namespaces(s Store) ([]NamespaceStats, error) {
+	var all []NamespaceStats
+	err := s.Scan(namespaceMark, "\x01", func(key, value string) error {
+		parts := strings.SplitN(key, namespaceMark, 3)
+		if len(parts) != 3 {
+			return nil
+		}
+		if len(all) == 0 || all[len(all)-1].Name != parts[1] {
+			all = append(all, NamespaceStats{Name: parts[1]})
+		}
+		stats := &all[len(all)-1]
+		stats.Keys++
+		stats.Bytes += int64(len(parts[2]) + len(value))
+		return nil
+	})
+	return all, err
+}
+
+// trimKeyWriter removes a prefix from the keys of export records written
+// to it line by line.
+type trimKeyWriter struct {
+	w      io.Writer
+	prefix string
+	line   []byte
+}
+
+func (t *trimKeyWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.line = append(t.line, p...)
+			break
+		}
+		t.line = append(t.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := t.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffered line with its key trimmed.
+func (t *trimKeyWriter) flush() error {
+	if len(t.line) == 0 {
+		return nil
+	}
+	var r exportRecord
+	if err := json.Unmarshal(t.line, &r); err != nil {
+		return err
+	}
+	t.line = t.line[:0]
+	r.Key = strings.TrimPrefix(r.Key, t.prefix)
+	return json.NewEncoder(t.w).Encode(r)
+}
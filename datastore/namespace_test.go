@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	teamA, err := db.Namespace("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamAB, err := db.Namespace("ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i%10)
+		if err := teamA.Put(key, fmt.Sprintf("a%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := teamAB.Put(key, fmt.Sprintf("ab%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := teamA.PutInt64("count", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key01", "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("isolation", func(t *testing.T) {
+		for store, expected := range map[Store]string{db: "plain", teamA: "a21", teamAB: "ab21"} {
+			if v, err := store.Get("key01"); err != nil || v != expected {
+				t.Errorf("Expected %s, got %s %v", expected, v, err)
+			}
+		}
+		if _, err := teamAB.GetInt64("count"); err != ErrNotFound {
+			t.Errorf("Expected count to be missing from another namespace, got %v", err)
+		}
+
+		var keys []string
+		err := teamA.Scan("key08", "", func(key, value string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"key08", "key09"}) {
+			t.Errorf("Unexpected scan %v", keys)
+		}
+
+		reserved := NamespaceKey("a", "key01")
+		if err := db.Put(reserved, "forged"); err != ErrReservedKey {
+			t.Errorf("Expected ErrReservedKey for a plain put, got %v", err)
+		}
+		if err := db.PutInt64(reserved, 1); err != ErrReservedKey {
+			t.Errorf("Expected ErrReservedKey for a plain put, got %v", err)
+		}
+		if err := db.Delete(reserved); err != ErrReservedKey {
+			t.Errorf("Expected ErrReservedKey for a plain delete, got %v", err)
+		}
+		if name, key, ok := SplitNamespaceKey(reserved); !ok || name != "a" || key != "key01" {
+			t.Errorf("Bad split of %q: %q %q %v", reserved, name, key, ok)
+		}
+		if _, _, ok := SplitNamespaceKey("key01"); ok {
+			t.Error("Split a plain key")
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := teamAB.ExportRange(&out, "key03", "key05", 0); err != nil {
+			t.Fatal(err)
+		}
+		expected := `{"key":"key03","type":"string","value":"ab23"}` + "\n" +
+			`{"key":"key04","type":"string","value":"ab24"}` + "\n"
+		if out.String() != expected {
+			t.Errorf("Unexpected export:\n%s", out.String())
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := Namespaces(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []NamespaceStats{
+			{Name: "a", Keys: 11, Bytes: 10*(5+3) + 5 + 1},
+			{Name: "ab", Keys: 10, Bytes: 10 * (5 + 4)},
+		}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+		if s, err := teamAB.Stats(); err != nil || s != expected[1] {
+			t.Errorf("Expected %+v, got %+v %v", expected[1], s, err)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := teamA.Drop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := teamA.Get("key01"); err != ErrNotFound {
+			t.Errorf("Expected dropped keys to be gone, got %v", err)
+		}
+		if v, err := teamAB.Get("key01"); err != nil || v != "ab21" {
+			t.Errorf("Dropping a namespace changed another one: %s %v", v, err)
+		}
+		if v, err := db.Get("key01"); err != nil || v != "plain" {
+			t.Errorf("Dropping a namespace changed plain keys: %s %v", v, err)
+		}
+		if stats, _ := Namespaces(db); len(stats) != 1 || stats[0].Name != "ab" {
+			t.Errorf("Unexpected namespaces after drop %+v", stats)
+		}
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		n, err := NewNamespace(NewMemDb(), "m")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Drop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.Get("k"); err != ErrNotFound {
+			t.Errorf("Expected k to be dropped, got %v", err)
+		}
+	})
+
+	for _, name := range []string{"", "a/b", "a\x00b"} {
+		if _, err := db.Namespace(name); err != ErrBadNamespace {
+			t.Errorf("Expected %q to be rejected, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ErrQuotaExceeded = fmt.Errorf("write exceeds the storage quota")
+
+// WithMaxKeySize rejects writes of keys longer than n bytes with
+// ErrTooLarge. Unlike MaxKeySize it only applies to this Db and to new
+// writes, so it can be lowered below the keys already stored.
+func WithMaxKeySize(n int) Option {
+	return func(db *Db) {
+		db.quota.maxKey = n
+	}
+}
+
+// WithMaxValueSize rejects writes of values longer than n bytes with
+// ErrTooLarge, like WithMaxKeySize.
+func WithMaxValueSize(n int) Option {
+	return func(db *Db) {
+		db.quota.maxValue = n
+	}
+}
+
+// WithQuota rejects writes with ErrQuotaExceeded once the keys and values
+// of all live keys would take more than n bytes. Records that are
+// overwritten or deleted but not merged away yet do not count. Deletes
+// and writes that shrink a value always succeed.
+func WithQuota(n int64) Option {
+	return func(db *Db) {
+		db.quota.maxBytes = n
+	}
+}
+
+// WithNamespaceQuota limits the live bytes of every namespace to n, like
+// WithQuota does for the whole Db.
+func WithNamespaceQuota(n int64) Option {
+	return func(db *Db) {
+		db.quota.maxNamespaceBytes = n
+	}
+}
+
+// quota enforces the per-Db limits. Live bytes are only tracked with a
+// quota set: the size of every key is then kept in memory and counted
+// again from all keys when the Db opens.
+type quota struct {
+	maxKey, maxValue            int
+	maxBytes, maxNamespaceBytes int64
+
+	sizes      map[string]int64
+	total      int64
+	namespaces map[string]int64
+}
+
+func (q *quota) tracking() bool {
+	return q.maxBytes > 0 || q.maxNamespaceBytes > 0
+}
+
+// liveSize is how much of the quota the latest record of a key takes:
+// the key, without its namespace like in NamespaceStats, and the value.
+func liveSize(e entry) int64 {
+	if e.valueType == tombstoneType {
+		return 0
+	}
+	ns := namespaceOf(e.key)
+	if ns != "" {
+		return int64(len(e.key) - len(NamespaceKey(ns, "")) + len(e.value))
+	}
+	return int64(len(e.key) + len(e.value))
+}
+
+// namespaceOf returns the namespace of a stored key, "" for plain keys.
+func namespaceOf(key string) string {
+	if !strings.HasPrefix(key, namespaceMark) {
+		return ""
+	}
+	parts := strings.SplitN(key, namespaceMark, 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// check returns the error writing e would break a limit with.
+func (q *quota) check(e entry) error {
+	if e.valueType != tombstoneType {
+		if (q.maxKey > 0 && len(e.key) > q.maxKey) || (q.maxValue > 0 && len(e.value) > q.maxValue) {
+			return ErrTooLarge
+		}
+	}
+	if !q.tracking() {
+		return nil
+	}
+	growth := liveSize(e) - q.sizes[e.key]
+	if growth <= 0 {
+		return nil
+	}
+	if q.maxBytes > 0 && q.total+growth > q.maxBytes {
+		return ErrQuotaExceeded
+	}
+	if ns := namespaceOf(e.key); ns != "" && q.maxNamespaceBytes > 0 && q.namespaces[ns]+growth > q.maxNamespaceBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// add counts e, the latest record of its key.
+func (q *quota) add(e entry) {
+	if !q.tracking() {
+		return
+	}
+	if q.sizes == nil {
+		q.sizes = make(map[string]int64)
+		q.namespaces = make(map[string]int64)
+	}
+	size := liveSize(e)
+	growth := size - q.sizes[e.key]
+	if size == 0 {
+		delete(q.sizes, e.key)
+	} else {
+		q.sizes[e.key] = size
+	}
+	q.total += growth
+	if ns := namespaceOf(e.key); ns != "" {
+		q.namespaces[ns] += growth
+		if q.namespaces[ns] == 0 {
+			delete(q.namespaces, ns)
+		}
+	}
+}
+
+// Usage returns the live bytes of the Db and of every namespace, which
+// are only counted when a quota is set.
+func (db *Db) Usage() (int64, map[string]int64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	namespaces := make(map[string]int64, len(db.quota.namespaces))
+	for ns, n := range db.quota.namespaces {
+		namespaces[ns] = n
+	}
+	return db.quota.total, namespaces
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDb_Quota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithMaxKeySize(8), WithMaxValueSize(20), WithQuota(100), WithNamespaceQuota(30)}
+	db, err := NewDb(currentFile, dir, 200, true, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sizes", func(t *testing.T) {
+		if err := db.Put("long-key!", "v"); err != ErrTooLarge {
+			t.Errorf("Expected ErrTooLarge for a long key, got %v", err)
+		}
+		if err := db.Put("k", strings.Repeat("v", 21)); err != ErrTooLarge {
+			t.Errorf("Expected ErrTooLarge for a long value, got %v", err)
+		}
+		if err := db.Delete("long-key!"); err != nil {
+			t.Errorf("Deleting is not limited, got %v", err)
+		}
+	})
+
+	t.Run("total", func(t *testing.T) {
+		// Four keys of 2+18 bytes and an overwrite that does not grow.
+		for _, key := range []string{"k1", "k2", "k3", "k4", "k4"} {
+			if err := db.Put(key, strings.Repeat("v", 18)); err != nil {
+				t.Fatalf("Cannot put %s: %s", key, err)
+			}
+		}
+		if err := db.Put("k5", strings.Repeat("v", 19)); err != ErrQuotaExceeded {
+			t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+		}
+		if err := db.Put("k5", strings.Repeat("v", 18)); err != nil {
+			t.Errorf("Expected the last 20 bytes to fit, got %v", err)
+		}
+		if err := db.Put("k6", "v"); err != ErrQuotaExceeded {
+			t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+		}
+		if err := db.Delete("k1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("k6", "v"); err != nil {
+			t.Errorf("Expected a deletion to free space, got %v", err)
+		}
+	})
+
+	t.Run("namespace", func(t *testing.T) {
+		if err := db.Delete("k2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("k3"); err != nil {
+			t.Fatal(err)
+		}
+		ns, err := db.Namespace("team")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Put("a", strings.Repeat("v", 19)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Put("b", strings.Repeat("v", 10)); err != ErrQuotaExceeded {
+			t.Errorf("Expected ErrQuotaExceeded in the namespace, got %v", err)
+		}
+		if err := ns.Put("b", strings.Repeat("v", 9)); err != nil {
+			t.Errorf("Expected the namespace to have 10 bytes left, got %v", err)
+		}
+	})
+
+	total, namespaces := db.Usage()
+	expected := map[string]int64{"team": 30}
+	if total != 20+20+3+30 || !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("Unexpected usage %d %v", total, namespaces)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDb(currentFile, dir, 200, true, opts...); err != nil {
+			t.Fatal(err)
+		}
+		if t2, n2 := db.Usage(); t2 != total || !reflect.DeepEqual(n2, expected) {
+			t.Errorf("Usage after reopening is %d %v, expected %d %v", t2, n2, total, expected)
+		}
+	})
+	db.Close()
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrNoIndex = fmt.Errorf("no such secondary index")
+
+// WithIndex declares a secondary index called name on the field at path,
+// like "team" or "address.city", of string values that hold JSON objects.
+// Fields that are strings, numbers or booleans are indexed by their text;
+// other values are left out. Indexes live in memory: they are updated
+// together with every write and rebuilt from all keys when the Db opens.
+func WithIndex(name, path string) Option {
+	return func(db *Db) {
+		if db.secondary == nil {
+			db.secondary = make(map[string]*secondaryIndex)
+		}
+		db.secondary[name] = &secondaryIndex{
+			path:   strings.Split(path, "."),
+			fields: make(map[string]string),
+			keys:   make(map[string]map[string]bool),
+		}
+	}
+}
+
+type secondaryIndex struct {
+	path []string
+	// fields holds the indexed field value of every key, keys the keys
+	// with every field value.
+	fields map[string]string
+	keys   map[string]map[string]bool
+}
+
+// update indexes the latest record of a key, which may be a tombstone.
+func (i *secondaryIndex) update(e entry) {
+	if old, ok := i.fields[e.key]; ok {
+		delete(i.fields, e.key)
+		delete(i.keys[old], e.key)
+		if len(i.keys[old]) == 0 {
+			delete(i.keys, old)
+		}
+	}
+	if e.valueType != "s" {
+		return
+	}
+	field, ok := fieldAt(e.value, i.path)
+	if !ok {
+		return
+	}
+	i.fields[e.key] = field
+	if i.keys[field] == nil {
+		i.keys[field] = make(map[string]bool)
+	}
+	i.keys[field][e.key] = true
+}
+
+// fieldAt returns the text of the scalar field at path of a JSON object.
+func fieldAt(value string, path []string) (string, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return "", false
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, name := range path {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v = object[name]
+	}
+	switch field := v.(type) {
+	case string:
+		return field, true
+	case json.Number:
+		return field.String(), true
+	case bool:
+		return fmt.Sprint(field), true
+	default:
+		return "", false
+	}
+}
+
+// updateIndexes indexes a record just written. The caller must hold the
+// write lock.
+func (db *Db) updateIndexes(e entry) {
+	for _, i := range db.secondary {
+		i.update(e)
+	}
+}
+
+// QueryIndex returns the keys, in ascending order, whose field indexed by
+// index name has the given value.
+func (db *Db) QueryIndex(name, value string) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	i, ok := db.secondary[name]
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(i.keys[value]))
+	for key := range i.keys[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_QueryIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithIndex("team", "team"), WithIndex("city", "address.city"), WithValueLog(40)}
+	db, err := NewDb(currentFile, dir, 300, true, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		team := []string{"ops", "dev"}[i%2]
+		value := fmt.Sprintf(`{"team": %q, "address": {"city": "Kyiv"}, "n": %d}`, team, i)
+		if err := db.Put(fmt.Sprintf("user%02d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Moving a user to another team, deleting one and storing values
+	// without the field all update the index.
+	if err := db.Put("user00", `{"team": "dev"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user02"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user04", "not json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("user06", 6); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := db.Namespace("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Put("user99", `{"team": "ops"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		expected := []string{NamespaceKey("other", "user99"), "user08", "user10", "user12", "user14", "user16", "user18"}
+		if keys, err := db.QueryIndex("team", "ops"); err != nil || !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %v, got %v %v", expected, keys, err)
+		}
+		if keys, err := db.QueryIndex("city", "Kyiv"); err != nil || len(keys) != 16 {
+			t.Errorf("Expected 16 users in Kyiv, got %v %v", keys, err)
+		}
+		if keys, err := db.QueryIndex("team", "qa"); err != nil || len(keys) != 0 {
+			t.Errorf("Expected no keys, got %v %v", keys, err)
+		}
+		if _, err := db.QueryIndex("missing", "x"); err != ErrNoIndex {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+		ns, _ := db.Namespace("other")
+		if keys, err := ns.QueryIndex("team", "ops"); err != nil || !reflect.DeepEqual(keys, []string{"user99"}) {
+			t.Errorf("Unexpected namespace query %v %v", keys, err)
+		}
+	}
+	check(t, db)
+
+	t.Run("rebuild", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(currentFile, dir, 300, true, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+	db.Close()
+}
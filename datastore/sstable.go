@@ -0,0 +1,306 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	tableFooterSize  = 16
+	tableMagic       = 0x5354424c
+	tableBlockRecord = 16
+)
+
+var ErrCorruptedTable = fmt.Errorf("corrupted table file")
+
+type sparseKey struct {
+	key    string
+	offset int64
+}
+
+// table is an immutable sorted string table. Records are stored in key
+// order and every tableBlockRecord-th record (plus the last one) is kept
+// in a sparse in-memory index, so a lookup reads at most one block.
+type table struct {
+	path    string
+	file    File
+	size    int64
+	dataEnd int64
+	index   []sparseKey
+}
+
+func writeTable(fs FS, path string, entries []entry) (*table, error) {
+	f, err := createFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(f)
+
+	var (
+		offset int64
+		index  []sparseKey
+	)
+	for i, e := range entries {
+		if i%tableBlockRecord == 0 || i == len(entries)-1 {
+			index = append(index, sparseKey{key: e.key, offset: offset})
+		}
+		n, err := out.Write(e.Encode())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		offset += int64(n)
+	}
+
+	indexOffset := offset
+	for _, k := range index {
+		if _, err := writeKeyRecord(out, k); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	footer := make([]byte, tableFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(indexOffset))
+	binary.LittleEndian.PutUint32(footer[8:], uint32(len(index)))
+	binary.LittleEndian.PutUint32(footer[12:], tableMagic)
+	if _, err := out.Write(footer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := out.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return openTable(fs, path)
+}
+
+func openTable(fs FS, path string) (*table, error) {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
+	if size < tableFooterSize {
+		f.Close()
+		return nil, ErrCorruptedTable
+	}
+
+	footer := make([]byte, tableFooterSize)
+	if _, err := f.ReadAt(footer, size-tableFooterSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[12:]) != tableMagic {
+		f.Close()
+		return nil, ErrCorruptedTable
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	count := int(binary.LittleEndian.Uint32(footer[8:]))
+	if indexOffset > size-tableFooterSize {
+		f.Close()
+		return nil, ErrCorruptedTable
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(f, indexOffset, size-tableFooterSize-indexOffset))
+	index := make([]sparseKey, 0, count)
+	for i := 0; i < count; i++ {
+		k, _, err := readKeyRecord(in)
+		if err != nil {
+			f.Close()
+			return nil, ErrCorruptedTable
+		}
+		index = append(index, k)
+	}
+
+	return &table{
+		path:    path,
+		file:    f,
+		size:    size,
+		dataEnd: indexOffset,
+		index:   index,
+	}, nil
+}
+
+func (t *table) minKey() string {
+	if len(t.index) == 0 {
+		return ""
+	}
+	return t.index[0].key
+}
+
+func (t *table) maxKey() string {
+	if len(t.index) == 0 {
+		return ""
+	}
+	return t.index[len(t.index)-1].key
+}
+
+func (t *table) overlaps(start, end string) bool {
+	if len(t.index) == 0 {
+		return false
+	}
+	return t.maxKey() >= start && (end == "" || t.minKey() < end)
+}
+
+func (t *table) get(key string) (entry, bool, error) {
+	if len(t.index) == 0 || key < t.minKey() || key > t.maxKey() {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	from := t.index[i].offset
+	to := t.dataEnd
+	if i+1 < len(t.index) {
+		to = t.index[i+1].offset
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(t.file, from, to-from))
+	for {
+		e, _, err := readEntry(in)
+		if err == io.EOF {
+			return entry{}, false, nil
+		} else if err != nil {
+			return entry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			return entry{}, false, nil
+		}
+	}
+}
+
+func (t *table) iterator(start string) *tableIterator {
+	from := int64(0)
+	if len(t.index) > 0 {
+		i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > start }) - 1
+		if i > 0 {
+			from = t.index[i].offset
+		}
+	}
+	it := &tableIterator{
+		in: bufio.NewReader(io.NewSectionReader(t.file, from, t.dataEnd-from)),
+	}
+	for it.next() {
+		if it.current.key >= start {
+			break
+		}
+	}
+	return it
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+type entryIterator interface {
+	valid() bool
+	entry() entry
+	next() bool
+	err() error
+}
+
+type tableIterator struct {
+	in      *bufio.Reader
+	current entry
+	ok      bool
+	failure error
+}
+
+func (it *tableIterator) valid() bool  { return it.ok }
+func (it *tableIterator) entry() entry { return it.current }
+func (it *tableIterator) err() error   { return it.failure }
+
+func (it *tableIterator) next() bool {
+	e, _, err := readEntry(it.in)
+	if err != nil {
+		if err != io.EOF {
+			it.failure = err
+		}
+		it.ok = false
+		return false
+	}
+	it.current = e
+	it.ok = true
+	return true
+}
+
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func (it *sliceIterator) valid() bool  { return it.pos < len(it.entries) }
+func (it *sliceIterator) entry() entry { return it.entries[it.pos] }
+func (it *sliceIterator) err() error   { return nil }
+
+func (it *sliceIterator) next() bool {
+	it.pos++
+	return it.valid()
+}
+
+// mergeIterator yields keys from several sorted sources in order. When a
+// key is present in more than one source, the value from the source with
+// the lowest position wins, so sources must be passed newest first.
+type mergeIterator struct {
+	sources []entryIterator
+	current entry
+	ok      bool
+}
+
+func newMergeIterator(sources []entryIterator) *mergeIterator {
+	m := &mergeIterator{sources: sources}
+	m.next()
+	return m
+}
+
+func (m *mergeIterator) valid() bool  { return m.ok }
+func (m *mergeIterator) entry() entry { return m.current }
+
+func (m *mergeIterator) err() error {
+	for _, s := range m.sources {
+		if err := s.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergeIterator) next() bool {
+	winner := -1
+	for i, s := range m.sources {
+		if s.valid() && (winner == -1 || s.entry().key < m.sources[winner].entry().key) {
+			winner = i
+		}
+	}
+	if winner == -1 {
+		m.ok = false
+		return false
+	}
+
+	m.current = m.sources[winner].entry()
+	m.ok = true
+	for _, s := range m.sources {
+		if s.valid() && s.entry().key == m.current.key {
+			s.next()
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histograms.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Latency is a histogram of how long operations took. Buckets[i] counts
+// the operations that took at most LatencyBuckets[i], so the counts grow
+// with i like those of Prometheus histograms.
+type Latency struct {
+	Count   int64
+	Total   time.Duration
+	Buckets []int64
+}
+
+func (l *Latency) observe(d time.Duration) {
+	if l.Buckets == nil {
+		l.Buckets = make([]int64, len(LatencyBuckets))
+	}
+	l.Count++
+	l.Total += d
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			l.Buckets[i]++
+		}
+	}
+}
+
+func (l Latency) copy() Latency {
+	l.Buckets = append([]int64(nil), l.Buckets...)
+	if l.Buckets == nil {
+		l.Buckets = make([]int64, len(LatencyBuckets))
+	}
+	return l
+}
+
+// Stats are counters of a Db since it was opened. The key and byte counts
+// are kept for every data file by writes, rollovers and merges, so reading
+// them is cheap; see DirStats for exact figures.
+type Stats struct {
+	// Keys counts the keys of every file by itself, so a key written again
+	// since the last merge counts more than once.
+	Keys int
+	// LiveBytes are taken by the latest records of keys in every file,
+	// DeadBytes by the records overwritten within a file and tombstones.
+	LiveBytes int64
+	DeadBytes int64
+	Segments  int
+	// IndexEntries is how many keys the indexes hold in memory.
+	IndexEntries int
+
+	Merges         int64
+	MergeTime      time.Duration
+	ReclaimedBytes int64
+
+	// Puts covers every write from the call until it is on disk, QueueWait
+	// the part of it spent waiting for the writer.
+	Puts      Latency
+	QueueWait Latency
+	Gets      Latency
+}
+
+// fileUsage counts the keys whose latest record in a data file is not a
+// tombstone, and the bytes of those records.
+type fileUsage struct {
+	keys int
+	live int64
+}
+
+// usage holds the size of the latest record of every live key of the
+// current file, which is bounded by the segment size. Sealed segments
+// only keep the totals.
+type usage struct {
+	live  int64
+	sizes map[string]int
+}
+
+// record counts e, a record of size bytes that is now the latest of its key.
+func (u *usage) record(e entry, size int) {
+	if u.sizes == nil {
+		u.sizes = make(map[string]int)
+	}
+	if old, ok := u.sizes[e.key]; ok {
+		u.live -= int64(old)
+		delete(u.sizes, e.key)
+	}
+	if e.valueType != tombstoneType {
+		u.sizes[e.key] = size
+		u.live += int64(size)
+	}
+}
+
+func (u *usage) total() fileUsage {
+	return fileUsage{keys: len(u.sizes), live: u.live}
+}
+
+// metrics holds the counters of Stats that are updated as the Db runs.
+type metrics struct {
+	mu             sync.Mutex
+	merges         int64
+	mergeTime      time.Duration
+	reclaimedBytes int64
+	puts           Latency
+	queueWait      Latency
+	gets           Latency
+}
+
+func (m *metrics) observe(l *Latency, since time.Time) {
+	d := time.Since(since)
+	m.mu.Lock()
+	l.observe(d)
+	m.mu.Unlock()
+}
+
+func (m *metrics) merged(since time.Time, reclaimed int64) {
+	d := time.Since(since)
+	m.mu.Lock()
+	m.merges++
+	m.mergeTime += d
+	m.reclaimedBytes += reclaimed
+	m.mu.Unlock()
+}
+
+// indexEntries returns how many keys i keeps in memory.
+func indexEntries(i segmentIndex) int {
+	switch i := i.(type) {
+	case hashIndex:
+		return len(i)
+	case sortedIndex:
+		return len(i)
+	case *diskIndex:
+		return len(i.sample)
+	default:
+		return 0
+	}
+}
+
+// Stats returns the counters of the Db. Apart from a look at the header
+// of every data file, it reads nothing from disk.
+func (db *Db) Stats() (Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Stats{}, ErrClosed
+	}
+
+	s := Stats{Segments: len(db.segments)}
+	var stored int64
+	add := func(path string, size int64, index segmentIndex, u fileUsage) error {
+		h, err := readFileHeaderAt(db.fs, path)
+		if err != nil {
+			return err
+		}
+		stored += size - h.dataStart()
+		s.Keys += u.keys
+		s.LiveBytes += u.live
+		s.IndexEntries += indexEntries(index)
+		return nil
+	}
+	for _, seg := range db.segments {
+		if err := add(seg.outPath, seg.outOffset, seg.index, seg.usage); err != nil {
+			return Stats{}, err
+		}
+	}
+	if err := add(db.outPath, db.outOffset, db.index, db.usage.total()); err != nil {
+		return Stats{}, err
+	}
+	s.DeadBytes = stored - s.LiveBytes
+
+	db.metrics.mu.Lock()
+	defer db.metrics.mu.Unlock()
+	s.Merges = db.metrics.merges
+	s.MergeTime = db.metrics.mergeTime
+	s.ReclaimedBytes = db.metrics.reclaimedBytes
+	s.Puts = db.metrics.puts.copy()
+	s.QueueWait = db.metrics.queueWait.copy()
+	s.Gets = db.metrics.gets.copy()
+	return s, nil
+}
@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 200, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// Overwrites and deletes roll over enough segments for merges.
+	for i := 0; i < 60; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := db.Delete(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil && err != ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys written again since the last merge count once in every file.
+	if s.Keys < 6 || s.Keys > 10 {
+		t.Errorf("Expected 6 to 10 keys, got %d", s.Keys)
+	}
+	// Every live record has a 16 byte header, a 4 byte key, a 1 byte type
+	// and a 7 byte value.
+	if s.LiveBytes != int64(s.Keys)*28 || s.DeadBytes < 0 {
+		t.Errorf("Expected %d keys of 28 bytes, got %d live and %d dead bytes", s.Keys, s.LiveBytes, s.DeadBytes)
+	}
+	files, err := DirStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int64
+	for _, f := range files {
+		stored += f.LiveBytes + f.DeadBytes
+	}
+	if s.LiveBytes+s.DeadBytes != stored {
+		t.Errorf("Expected %d bytes in files, got %d live and %d dead", stored, s.LiveBytes, s.DeadBytes)
+	}
+	if s.Segments != len(files)-1 {
+		t.Errorf("Expected %d segments, got %d", len(files)-1, s.Segments)
+	}
+	if s.IndexEntries < s.Keys {
+		t.Errorf("Expected at least %d index entries, got %d", s.Keys, s.IndexEntries)
+	}
+	if s.Merges == 0 || s.ReclaimedBytes <= 0 || s.MergeTime <= 0 {
+		t.Errorf("Expected merges to reclaim space, got %d merges reclaiming %d", s.Merges, s.ReclaimedBytes)
+	}
+
+	for name, l := range map[string]Latency{"puts": s.Puts, "queue": s.QueueWait, "gets": s.Gets} {
+		expected := int64(64)
+		if name == "gets" {
+			expected = 5
+		}
+		if l.Count != expected || len(l.Buckets) != len(LatencyBuckets) {
+			t.Errorf("Expected %d %s, got %+v", expected, name, l)
+		}
+		for i := 1; i < len(l.Buckets); i++ {
+			if l.Buckets[i] < l.Buckets[i-1] || l.Buckets[i] > l.Count {
+				t.Errorf("Buckets of %s are not cumulative: %v", name, l.Buckets)
+			}
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(currentFile, dir, 200, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Keys != s.Keys || reopened.LiveBytes != s.LiveBytes || reopened.DeadBytes != s.DeadBytes {
+		t.Errorf("Expected the counts of %+v after reopening, got %+v", s, reopened)
+	}
+
+	// With a disk index the counts of sealed segments come from the
+	// manifest instead of a scan.
+	for i := 0; i < 2; i++ {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(currentFile, dir, 200, true, WithDiskIndex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened, err = db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reopened.Keys != s.Keys || reopened.LiveBytes != s.LiveBytes || reopened.DeadBytes != s.DeadBytes {
+			t.Errorf("Expected the counts of %+v with a disk index, got %+v", s, reopened)
+		}
+	}
+}
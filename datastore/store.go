@@ -0,0 +1,28 @@
+package datastore
+
+import "context"
+
+// Store is the key-value API shared by Db, LsmDb and MemDb. The function
+// passed to Scan must not write to the store.
+type Store interface {
+	Get(key string) (string, error)
+	GetInt64(key string) (int64, error)
+	Put(key, value string) error
+	PutInt64(key string, value int64) error
+	Delete(key string) error
+	Scan(start, end string, fn func(key, value string) error) error
+
+	GetContext(ctx context.Context, key string) (string, error)
+	GetInt64Context(ctx context.Context, key string) (int64, error)
+	PutContext(ctx context.Context, key, value string) error
+	PutInt64Context(ctx context.Context, key string, value int64) error
+	DeleteContext(ctx context.Context, key string) error
+
+	Close() error
+}
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*LsmDb)(nil)
+	_ Store = (*MemDb)(nil)
+)
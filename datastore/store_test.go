@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := []struct {
+		name string
+		open func(dir string) (Store, error)
+	}{
+		{"bitcask", func(dir string) (Store, error) { return NewDb(currentFile, dir, 200, true) }},
+		{"lsm", func(dir string) (Store, error) { return NewLsmDb(dir, 200) }},
+		{"memory", func(string) (Store, error) { return NewMemDb(), nil }},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			storeDir, err := ioutil.TempDir(dir, s.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := s.open(storeDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// Enough writes to roll over segments and flush tables, so
+			// that deletions have older values to hide.
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key%02d", i%20)
+				if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatalf("Cannot put %s: %s", key, err)
+				}
+			}
+			if err := db.PutInt64("number", 7); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i += 2 {
+				if err := db.Delete(fmt.Sprintf("key%02d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Delete("missing"); err != nil {
+				t.Errorf("Deleting a missing key failed: %s", err)
+			}
+
+			for i := 80; i < 100; i++ {
+				key := fmt.Sprintf("key%02d", i%20)
+				value, err := db.Get(key)
+				if i%2 == 0 {
+					if err != ErrNotFound {
+						t.Errorf("Expected deleted %s to be missing, got %q (%v)", key, value, err)
+					}
+				} else if err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Errorf("Bad value returned for %s: %q (%v)", key, value, err)
+				}
+			}
+			if v, err := db.GetInt64("number"); err != nil || v != 7 {
+				t.Errorf("Bad int64 value %d (%v)", v, err)
+			}
+
+			var keys []string
+			err = db.Scan("key05", "key15", func(key, value string) error {
+				keys = append(keys, key+"="+value)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := fmt.Sprint([]string{"key05=value85", "key07=value87", "key09=value89",
+				"key11=value91", "key13=value93"})
+			if fmt.Sprint(keys) != expected {
+				t.Errorf("Unexpected scan %v", keys)
+			}
+
+			if err := db.Put("key00", "again"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := db.Get("key00"); err != nil || value != "again" {
+				t.Errorf("Cannot put a deleted key back: %q (%v)", value, err)
+			}
+		})
+	}
+}
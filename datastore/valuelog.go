@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const valueLogPrefix = "vlog-"
+
+// valuePointerType marks entries whose value lives in the value log. It is
+// prepended to the original value type, so "vs" points to a string value.
+const valuePointerType = "v"
+
+// movedPointerType marks the pointers value log collection writes for the
+// values it moves, like "vms" for a string. They are value pointers like
+// any other, but not changes of their keys.
+const movedPointerType = valuePointerType + "m"
+
+const valuePointerSize = 16
+
+type valuePointer struct {
+	file   int
+	offset int64
+	size   int
+}
+
+func (p valuePointer) encode() string {
+	res := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(res, uint32(p.file))
+	binary.LittleEndian.PutUint64(res[4:], uint64(p.offset))
+	binary.LittleEndian.PutUint32(res[12:], uint32(p.size))
+	return string(res)
+}
+
+func (p valuePointer) String() string {
+	return fmt.Sprintf("%s%d@%d+%d", valueLogPrefix, p.file, p.offset, p.size)
+}
+
+func decodeValuePointer(value string) (valuePointer, error) {
+	if len(value) != valuePointerSize {
+		return valuePointer{}, ErrCorruptedValueLog
+	}
+	data := []byte(value)
+	return valuePointer{
+		file:   int(binary.LittleEndian.Uint32(data)),
+		offset: int64(binary.LittleEndian.Uint64(data[4:])),
+		size:   int(binary.LittleEndian.Uint32(data[12:])),
+	}, nil
+}
+
+func isValuePointer(valueType string) bool {
+	return strings.HasPrefix(valueType, valuePointerType)
+}
+
+func isMovedValue(valueType string) bool {
+	return strings.HasPrefix(valueType, movedPointerType)
+}
+
+// valueLog stores large values apart from the key segments. Records are
+// full entries, so garbage collection can tell which key a value belongs
+// to. Files are rotated once they reach maxFileSize.
+type valueLog struct {
+	fs          FS
+	dir         string
+	maxFileSize int64
+	keys        *keyring
+	files       []int
+	current     File
+	offset      int64
+}
+
+func openValueLog(fs FS, dir string, maxFileSize int64, keys *keyring) (*valueLog, error) {
+	vl := &valueLog{fs: fs, dir: dir, maxFileSize: maxFileSize, keys: keys}
+
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), valueLogPrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(info.Name(), valueLogPrefix))
+		if err != nil {
+			continue
+		}
+		vl.files = append(vl.files, id)
+	}
+	sort.Ints(vl.files)
+
+	if len(vl.files) == 0 {
+		vl.files = append(vl.files, 1)
+	}
+	if err := vl.openCurrent(); err != nil {
+		return nil, err
+	}
+	if err := vl.dropTornTail(); err != nil {
+		vl.current.Close()
+		return nil, err
+	}
+	return vl, nil
+}
+
+func (vl *valueLog) path(id int) string {
+	return filepath.Join(vl.dir, valueLogPrefix+strconv.Itoa(id))
+}
+
+func (vl *valueLog) currentID() int {
+	return vl.files[len(vl.files)-1]
+}
+
+func (vl *valueLog) openCurrent() error {
+	f, size, err := openDataFile(vl.fs, vl.path(vl.currentID()))
+	if err != nil {
+		return err
+	}
+	vl.current = f
+	vl.offset = size
+	return nil
+}
+
+func (vl *valueLog) append(e entry) (valuePointer, error) {
+	encoded := vl.keys.encode(e)
+	if vl.offset > 0 && vl.offset+int64(len(encoded)) > vl.maxFileSize {
+		if err := vl.current.Close(); err != nil {
+			return valuePointer{}, err
+		}
+		vl.files = append(vl.files, vl.currentID()+1)
+		if err := vl.openCurrent(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	n, err := vl.current.Write(encoded)
+	if err != nil {
+		vl.current.Truncate(vl.offset)
+		return valuePointer{}, err
+	}
+	p := valuePointer{file: vl.currentID(), offset: vl.offset, size: n}
+	vl.offset += int64(n)
+	return p, nil
+}
+
+// dropTornTail cuts off a value a crash left half written at the end of
+// the current file, so that collection can walk the file to its end.
+func (vl *valueLog) dropTornTail() error {
+	f, err := openRead(vl.fs, vl.path(vl.currentID()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	h, err := readFileHeader(in)
+	if err != nil {
+		return err
+	}
+	offset := h.size()
+	for {
+		data, err := readRecord(in)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			vl.offset = offset
+			return vl.current.Truncate(offset)
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+}
+
+func (vl *valueLog) read(p valuePointer) (entry, error) {
+	f, err := openRead(vl.fs, vl.path(p.file))
+	if err != nil {
+		return entry{}, err
+	}
+	defer f.Close()
+	return readValueAt(f, p, vl.keys)
+}
+
+// readValueAt reads the value p points to from its open value log file.
+func readValueAt(f io.ReaderAt, p valuePointer, keys *keyring) (entry, error) {
+	e, _, err := keys.readEntry(bufio.NewReader(io.NewSectionReader(f, p.offset, int64(p.size))))
+	if err == ErrEncrypted || err == ErrWrongKey {
+		return entry{}, err
+	} else if err != nil {
+		return entry{}, ErrCorruptedValueLog
+	}
+	return e, nil
+}
+
+func (vl *valueLog) close() error {
+	if err := vl.current.Sync(); err != nil {
+		vl.current.Close()
+		return err
+	}
+	return vl.current.Close()
+}
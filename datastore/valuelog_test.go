@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_ValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 500, true, WithValueLog(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := func(k, i int) string {
+		return fmt.Sprintf("%d-%d-", k, i) + strings.Repeat("x", 100)
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			for k := 0; k < 5; k++ {
+				if err := db.Put(fmt.Sprintf("key%d", k), large(k, i)); err != nil {
+					t.Fatalf("Cannot put key%d: %s", k, err)
+				}
+			}
+		}
+		if err := db.Put("small", "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		for k := 0; k < 5; k++ {
+			value, err := db.Get(fmt.Sprintf("key%d", k))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", k, err)
+			}
+			if value != large(k, 4) {
+				t.Errorf("Bad value returned for key%d: %s", k, value)
+			}
+		}
+		if value, err := db.Get("small"); err != nil || value != "value" {
+			t.Errorf("Bad small value %s (%v)", value, err)
+		}
+		if _, typeOfValue, _ := db.getRaw("key0"); !isValuePointer(typeOfValue) {
+			t.Errorf("Large value was stored inline with type %s", typeOfValue)
+		}
+	})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		files := len(db.vlog.files)
+		if files < 2 {
+			t.Fatalf("Expected value log rotation, got %d files", files)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes, err := db.Watch(ctx, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		since, err := db.Snapshot(ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < files-1; i++ {
+			if err := db.CollectValueLog(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Moved values are not changes.
+		if err := db.Put("small", "after"); err != nil {
+			t.Fatal(err)
+		}
+		if c := <-changes; c.Key != "small" {
+			t.Errorf("Expected the put after the collection first, got %+v", c)
+		}
+		// Nor are they when a watcher resumes from before the collection.
+		resumed, err := db.Watch(ctx, "", since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := <-resumed; c.Key != "small" {
+			t.Errorf("Expected the replay to start with the put after the collection, got %+v", c)
+		}
+		if _, err := os.Stat(db.vlog.path(1)); !os.IsNotExist(err) {
+			t.Errorf("Collected value log file still exists")
+		}
+
+		for k := 0; k < 5; k++ {
+			value, err := db.Get(fmt.Sprintf("key%d", k))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", k, err)
+			}
+			if value != large(k, 4) {
+				t.Errorf("Bad value returned for key%d: %s", k, value)
+			}
+		}
+	})
+}
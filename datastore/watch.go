@@ -0,0 +1,211 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	ChangePut    = "put"
+	ChangeDelete = "delete"
+)
+
+// watchBuffer is how many changes a watcher may fall behind the writer
+// before it is dropped.
+const watchBuffer = 256
+
+var ErrWatchExpired = fmt.Errorf("changes after the sequence are no longer in the log")
+
+// Change describes one write to a Db. Sequence orders the changes: the
+// high 32 bits are the generation of the current file, which grows every
+// time it is sealed, and the low ones the offset of the record in it.
+type Change struct {
+	Sequence  uint64 `json:"seq"`
+	Key       string `json:"key"`
+	Type      string `json:"type"`
+	ValueType string `json:"valueType,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+func newChange(e entry, seq uint64) Change {
+	c := Change{Sequence: seq, Key: e.key, Type: ChangePut, Value: e.value}
+	switch e.valueType {
+	case "s":
+		c.ValueType = exportTypeString
+	case "i":
+		c.ValueType = exportTypeInt64
+	case tombstoneType:
+		c.Type = ChangeDelete
+	}
+	return c
+}
+
+type watcher struct {
+	prefix  string
+	changes chan Change
+}
+
+// watchers fans the changes made by the writer goroutine out to the
+// watchers. A watcher that falls behind is dropped, closing its channel.
+type watchers struct {
+	mu   sync.Mutex
+	all  map[*watcher]bool
+	done bool
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.done {
+		close(w.changes)
+		return
+	}
+	if ws.all == nil {
+		ws.all = make(map[*watcher]bool)
+	}
+	ws.all[w] = true
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.all[w] {
+		delete(ws.all, w)
+		close(w.changes)
+	}
+}
+
+func (ws *watchers) publish(c Change) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.all {
+		if !strings.HasPrefix(c.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.changes <- c:
+		default:
+			delete(ws.all, w)
+			close(w.changes)
+		}
+	}
+}
+
+func (ws *watchers) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.all {
+		close(w.changes)
+	}
+	ws.all = nil
+	ws.done = true
+}
+
+// sequence returns the sequence of a record written at offset of the
+// current file.
+func (db *Db) sequence(offset int64) uint64 {
+	return uint64(db.generation)<<32 | uint64(offset)
+}
+
+// Watch returns the changes to keys starting with prefix, made after the
+// change with sequence since, or from now on if since is 0. Changes still
+// in the current file are replayed from it; older ones are gone and Watch
+// fails with ErrWatchExpired. The channel is closed when ctx is done, the
+// Db is closed or the receiver falls too far behind; receivers can then
+// watch again from the last sequence they got.
+func (db *Db) Watch(ctx context.Context, prefix string, since uint64) (<-chan Change, error) {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	var replay []Change
+	if since != 0 {
+		var err error
+		if replay, err = db.changesSince(prefix, since); err != nil {
+			db.mu.RUnlock()
+			return nil, err
+		}
+	}
+	// The writer holds the write lock while it publishes, so no change
+	// falls between the replay and the subscription.
+	w := &watcher{prefix: prefix, changes: make(chan Change, watchBuffer)}
+	db.watchers.add(w)
+	db.mu.RUnlock()
+
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		defer db.watchers.remove(w)
+		for _, c := range replay {
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case c, ok := <-w.changes:
+				if !ok {
+					return
+				}
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// changesSince reads the changes after since from the current file,
+// leaving out the values CollectValueLog moved. The caller must hold the
+// read lock.
+func (db *Db) changesSince(prefix string, since uint64) ([]Change, error) {
+	if since>>32 != uint64(db.generation) || int64(since&(1<<32-1)) >= db.outOffset {
+		if since < db.sequence(db.outOffset) {
+			return nil, ErrWatchExpired
+		}
+		return nil, nil
+	}
+
+	input, err := openRead(db.fs, db.outPath)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	in := bufio.NewReader(io.LimitReader(input, db.outOffset))
+	h, err := readFileHeader(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	offset := h.size()
+	for {
+		e, n, err := db.keys.readEntry(in)
+		if err == io.EOF {
+			return changes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		seq := db.sequence(offset)
+		offset += int64(n)
+		if seq <= since || !strings.HasPrefix(e.key, prefix) || isMovedValue(e.valueType) {
+			continue
+		}
+		if e, err = db.resolve(e); err != nil {
+			return nil, err
+		}
+		changes = append(changes, newChange(e, seq))
+	}
+}
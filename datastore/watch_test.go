@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, changes <-chan Change) Change {
+	t.Helper()
+	select {
+	case c, ok := <-changes:
+		if !ok {
+			t.Fatal("Change channel closed")
+		}
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("No change received")
+	}
+	return Change{}
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	tempDir = dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(currentFile, dir, 300, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var first Change
+	t.Run("live changes", func(t *testing.T) {
+		changes, err := db.Watch(ctx, "user/", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("user/1", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("other", "ignored"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutInt64("user/2", 42); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("user/1"); err != nil {
+			t.Fatal(err)
+		}
+
+		first = receive(t, changes)
+		expected := []Change{
+			{Key: "user/1", Type: ChangePut, ValueType: "string", Value: "alice"},
+			{Key: "user/2", Type: ChangePut, ValueType: "int64", Value: "42"},
+			{Key: "user/1", Type: ChangeDelete},
+		}
+		got := []Change{first, receive(t, changes), receive(t, changes)}
+		for i, c := range got {
+			if i > 0 && c.Sequence <= got[i-1].Sequence {
+				t.Errorf("Sequence %d does not grow after %d", c.Sequence, got[i-1].Sequence)
+			}
+			c.Sequence = 0
+			if c != expected[i] {
+				t.Errorf("Expected change %+v, got %+v", expected[i], c)
+			}
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		changes, err := db.Watch(ctx, "", first.Sequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"other", "user/2", "user/1"} {
+			if c := receive(t, changes); c.Key != key {
+				t.Errorf("Expected a change of %s, got %+v", key, c)
+			}
+		}
+		if err := db.Put("user/3", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if c := receive(t, changes); c.Key != "user/3" {
+			t.Errorf("Expected a live change of user/3 after the replay, got %+v", c)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			if err := db.Put("filler", "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Watch(ctx, "", first.Sequence); err != ErrWatchExpired {
+			t.Errorf("Expected ErrWatchExpired after a rollover, got %v", err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		changes, err := db.Watch(context.Background(), "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case _, ok := <-changes:
+			if ok {
+				t.Error("Unexpected change after Close")
+			}
+		case <-time.After(time.Second):
+			t.Error("Close did not end the watch")
+		}
+		if _, err := db.Watch(ctx, "", 0); err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	})
+}
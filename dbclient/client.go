@@ -0,0 +1,196 @@
+package dbclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrNotFound = fmt.Errorf("record does not exist")
+
+// Record is a key with its value as the db servers export it: Type is
+// "string" or "int64" and Value the JSON of the value.
+type Record struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Client reads and writes every key on the db server the ring assigns it
+// to. Ring nodes are the base URLs of the servers, like http://db1:8070.
+type Client struct {
+	Ring *Ring
+	HTTP *http.Client
+}
+
+func NewClient(ring *Ring) *Client {
+	return &Client{Ring: ring, HTTP: http.DefaultClient}
+}
+
+// keyURL addresses key on node. The keys of namespaces, which scans return
+// as "\x00name\x00key", go to /db/name/key, as servers reject them as
+// plain keys.
+func keyURL(node, key string) string {
+	path := url.PathEscape(key)
+	if parts := strings.SplitN(key, "\x00", 3); len(parts) == 3 && parts[0] == "" {
+		path = url.PathEscape(parts[1]) + "/" + url.PathEscape(parts[2])
+	}
+	return strings.TrimSuffix(node, "/") + "/db/" + path
+}
+
+// URL returns the URL of key on the server it belongs to.
+func (c *Client) URL(key string) string {
+	return keyURL(c.Ring.Node(key), key)
+}
+
+// Get returns the JSON of the value of key.
+func (c *Client) Get(ctx context.Context, key string) (json.RawMessage, error) {
+	return c.GetFrom(ctx, c.Ring.Node(key), key)
+}
+
+// GetFrom returns the JSON of the value of key on node, wherever the ring
+// puts key.
+func (c *Client) GetFrom(ctx context.Context, node, key string) (json.RawMessage, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyURL(node, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var record Record
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// Put stores value, which must be a string or an int64, under key.
+func (c *Client) Put(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.PutTo(ctx, c.Ring.Node(key), key, data)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.DeleteFrom(ctx, c.Ring.Node(key), key)
+}
+
+// PutTo stores the JSON value under key on node, wherever the ring puts key.
+func (c *Client) PutTo(ctx context.Context, node, key string, value json.RawMessage) error {
+	body, err := json.Marshal(struct {
+		Value json.RawMessage `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, keyURL(node, key), body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteFrom removes key from node.
+func (c *Client) DeleteFrom(ctx context.Context, node, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyURL(node, key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Scan returns up to limit records of node with keys from start on, in
+// ascending key order. The next page starts right after the last key.
+func (c *Client) Scan(ctx context.Context, node, start string, limit int) ([]Record, error) {
+	q := url.Values{"start": {start}, "limit": {fmt.Sprint(limit)}}
+	resp, err := c.do(ctx, http.MethodGet, strings.TrimSuffix(node, "/")+"/db/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var records []Record
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var r Record
+		if err := decoder.Decode(&r); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return resp, nil
+}
+
+// Reshard moves the keys stored on the nodes of from to the nodes to
+// assigns them, reading every node in pages of batch keys. Every key is
+// written to its new node before it is deleted from the old one, so a
+// failed reshard can simply be run again. A key the new node already has
+// is only deleted from the old one, as the value there is newer. Writes
+// to the moving keys should still stop until the reshard is done: one
+// that lands on the old node after the key moved is lost. It returns how
+// many keys moved.
+func (c *Client) Reshard(ctx context.Context, from, to *Ring, batch int) (int, error) {
+	moved := 0
+	for _, node := range from.Nodes() {
+		start := ""
+		for {
+			records, err := c.Scan(ctx, node, start, batch)
+			if err != nil {
+				return moved, err
+			}
+			for _, r := range records {
+				target := to.Node(r.Key)
+				if target == node {
+					continue
+				}
+				if _, err := c.GetFrom(ctx, target, r.Key); err == ErrNotFound {
+					if err := c.PutTo(ctx, target, r.Key, r.Value); err != nil {
+						return moved, err
+					}
+				} else if err != nil {
+					return moved, err
+				}
+				if err := c.DeleteFrom(ctx, node, r.Key); err != nil {
+					return moved, err
+				}
+				moved++
+			}
+			if len(records) < batch {
+				break
+			}
+			// The smallest key after the last one.
+			start = records[len(records)-1].Key + "\x00"
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,142 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDb serves the /db/ API of a db server from a map of JSON values.
+type fakeDb struct {
+	mu   sync.Mutex
+	data map[string]json.RawMessage
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		var keys []string
+		for k := range f.data {
+			if k >= r.URL.Query().Get("start") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 && len(keys) > limit {
+			keys = keys[:limit]
+		}
+		for _, k := range keys {
+			_ = json.NewEncoder(rw).Encode(Record{Key: k, Type: "string", Value: f.data[k]})
+		}
+	case r.Method == http.MethodGet:
+		v, ok := f.data[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(Record{Key: key, Value: v})
+	case r.Method == http.MethodPost:
+		var body struct{ Value json.RawMessage }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.data[key] = body.Value
+	case r.Method == http.MethodDelete:
+		delete(f.data, key)
+	}
+}
+
+func TestClient(t *testing.T) {
+	dbs := make(map[string]*fakeDb)
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		db := &fakeDb{data: make(map[string]json.RawMessage)}
+		server := httptest.NewServer(db)
+		defer server.Close()
+		dbs[server.URL] = db
+		nodes = append(nodes, server.URL)
+	}
+	ctx := context.Background()
+
+	ring := NewRing(0, nodes[:2]...)
+	client := NewClient(ring)
+	for i := 0; i < 100; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, node := range nodes[:2] {
+		if len(dbs[node].data) == 0 {
+			t.Errorf("No keys on %s", node)
+		}
+	}
+	if v, err := client.Get(ctx, "key7"); err != nil || string(v) != `"value7"` {
+		t.Errorf("Bad value of key7: %s %v", v, err)
+	}
+	if _, err := client.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	t.Run("reshard", func(t *testing.T) {
+		grown := NewRing(0, nodes...)
+		// A write that reached the new node first is not overwritten.
+		newer := ""
+		for i := 0; newer == ""; i++ {
+			if key := fmt.Sprintf("key%d", i); grown.Node(key) == nodes[2] {
+				newer = key
+			}
+		}
+		dbs[nodes[2]].data[newer] = json.RawMessage(`"newer"`)
+
+		moved, err := client.Reshard(ctx, ring, grown, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved == 0 || moved != len(dbs[nodes[2]].data) {
+			t.Errorf("Moved %d keys, the new node has %d", moved, len(dbs[nodes[2]].data))
+		}
+
+		client := NewClient(grown)
+		total := 0
+		for _, db := range dbs {
+			total += len(db.data)
+		}
+		if total != 100 {
+			t.Errorf("Expected 100 keys after reshard, got %d", total)
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			expected := fmt.Sprintf(`"value%d"`, i)
+			if key == newer {
+				expected = `"newer"`
+			}
+			if v, err := client.Get(ctx, key); err != nil || string(v) != expected {
+				t.Errorf("Bad value of %s after reshard: %s %v", key, v, err)
+			}
+		}
+	})
+}
+
+func TestKeyURL(t *testing.T) {
+	for key, expected := range map[string]string{
+		"name":             "http://db1/db/name",
+		"a/b c":            "http://db1/db/a%2Fb%20c",
+		"\x00team\x00name": "http://db1/db/team/name",
+		"\x00team\x00a/b":  "http://db1/db/team/a%2Fb",
+	} {
+		if got := keyURL("http://db1/", key); got != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, key, got)
+		}
+	}
+}
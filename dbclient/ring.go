@@ -0,0 +1,146 @@
+// Package dbclient talks to db servers, spreading keys across several of
+// them with a consistent-hash ring.
+package dbclient
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points every node gets on a ring. More
+// points spread the keys more evenly.
+const DefaultVirtualNodes = 128
+
+// Ring assigns every key to a node by consistent hashing. Each node owns
+// the arcs of the hash circle ending at its virtual nodes, so adding a
+// node only takes keys over from the others, roughly 1/n of them, and
+// removing one hands its keys to the rest.
+//
+// All clients must use rings with the same nodes and virtual node count,
+// or they look for keys in different places. When a node is added, start
+// the new server first, run dbtool reshard from the old node list to the
+// new one and only then switch the clients over; writes made between the
+// reshard and the switch land on the old owner and need another reshard.
+type Ring struct {
+	vnodes int
+	points []uint32
+	owners map[uint32]string
+	nodes  map[string]bool
+}
+
+// NewRing places nodes on a ring with vnodes virtual nodes each, or
+// DefaultVirtualNodes if vnodes is not positive.
+func NewRing(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{vnodes: vnodes, owners: make(map[uint32]string), nodes: make(map[string]bool)}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+func hash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Add places node on the ring.
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		p := hash(node + "#" + strconv.Itoa(i))
+		// On the rare collision the smaller name wins, whatever the order
+		// nodes were added in.
+		if owner, ok := r.owners[p]; ok && owner < node {
+			continue
+		} else if !ok {
+			r.points = append(r.points, p)
+		}
+		r.owners[p] = node
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes node off the ring.
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	nodes := r.Nodes()
+	*r = *NewRing(r.vnodes, nodes...)
+}
+
+// Nodes returns the nodes of the ring in ascending order.
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Node returns the node key belongs to, or "" if the ring is empty.
+func (r *Ring) Node(key string) string {
+	return r.owner(hash(key))
+}
+
+// owner returns the node of the first point at or after p.
+func (r *Ring) owner(p uint32) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= p })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Move is a share of the keys, between 0 and 1, that changes node.
+type Move struct {
+	From, To string
+	Share    float64
+}
+
+// Moves compares two rings and reports which share of the keys goes from
+// which node to which, assuming keys hash evenly. Use it to see how much
+// data a reshard will copy before running it.
+func Moves(from, to *Ring) []Move {
+	points := append(append([]uint32(nil), from.points...), to.points...)
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	if len(points) == 0 {
+		return nil
+	}
+
+	shares := make(map[[2]string]float64)
+	prev := points[len(points)-1]
+	for _, p := range points {
+		// The arc (prev, p] has the same owners in both rings. The first
+		// arc wraps around zero.
+		if a, b := from.owner(p), to.owner(p); a != b {
+			shares[[2]string{a, b}] += float64(p-prev) / (1 << 32)
+		}
+		prev = p
+	}
+
+	moves := make([]Move, 0, len(shares))
+	for nodes, share := range shares {
+		moves = append(moves, Move{From: nodes[0], To: nodes[1], Share: share})
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].From != moves[j].From {
+			return moves[i].From < moves[j].From
+		}
+		return moves[i].To < moves[j].To
+	})
+	return moves
+}
@@ -0,0 +1,72 @@
+package dbclient
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(0, "db1", "db2", "db3")
+
+	t.Run("distribution", func(t *testing.T) {
+		counts := make(map[string]int)
+		for i := 0; i < 30000; i++ {
+			counts[ring.Node(fmt.Sprintf("key%d", i))]++
+		}
+		if len(counts) != 3 {
+			t.Fatalf("Expected keys on 3 nodes, got %v", counts)
+		}
+		for node, n := range counts {
+			if n < 7000 || n > 13000 {
+				t.Errorf("Uneven share of %s: %d of 30000", node, n)
+			}
+		}
+	})
+
+	t.Run("add", func(t *testing.T) {
+		grown := NewRing(0, "db1", "db2", "db3", "db4")
+		moved := 0
+		for i := 0; i < 30000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if before, after := ring.Node(key), grown.Node(key); before != after {
+				if after != "db4" {
+					t.Fatalf("%s moved from %s to %s instead of the new node", key, before, after)
+				}
+				moved++
+			}
+		}
+
+		total := 0.0
+		for _, m := range Moves(ring, grown) {
+			if m.To != "db4" {
+				t.Errorf("Unexpected move %+v", m)
+			}
+			total += m.Share
+		}
+		if share := float64(moved) / 30000; math.Abs(share-total) > 0.02 {
+			t.Errorf("Moves reported %.3f of keys, %.3f moved", total, share)
+		}
+		if total < 0.15 || total > 0.35 {
+			t.Errorf("Expected about a quarter of keys to move, got %.3f", total)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		shrunk := NewRing(0, "db1", "db2", "db3")
+		shrunk.Remove("db2")
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if before := ring.Node(key); before != "db2" && shrunk.Node(key) != before {
+				t.Fatalf("%s moved off %s that stays", key, before)
+			}
+		}
+		if nodes := shrunk.Nodes(); len(nodes) != 2 || nodes[0] != "db1" || nodes[1] != "db3" {
+			t.Errorf("Unexpected nodes %v", nodes)
+		}
+	})
+
+	if NewRing(0).Node("key") != "" {
+		t.Errorf("Expected no node on an empty ring")
+	}
+}
@@ -1,8 +1,10 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
@@ -24,13 +26,34 @@ func (s server) Start() {
 }
 
 func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+	return server{httpServer: newHTTPServer(fmt.Sprintf(":%d", port), handler, 10*time.Second)}
+}
+
+func newHTTPServer(addr string, handler http.Handler, timeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    timeout,
+		WriteTimeout:   timeout,
+		MaxHeaderBytes: 1 << 20,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
 		},
 	}
 }
+
+type connKey struct{}
+
+// NoTimeout lifts the read and write deadlines of the server for the
+// requests to h, for responses like event streams and backups that take
+// as long as they take. The read deadline goes too, as the server cancels
+// the request when it passes.
+func NoTimeout(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+			c.SetReadDeadline(time.Time{})
+			c.SetWriteDeadline(time.Time{})
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
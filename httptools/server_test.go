@@ -0,0 +1,49 @@
+package httptools
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNoTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("first "))
+		rw.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		if err := r.Context().Err(); err != nil && r.URL.Path == "/unlimited" {
+			t.Errorf("Request canceled: %s", err)
+		}
+		rw.Write([]byte("second"))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/limited", slow)
+	mux.Handle("/unlimited", NoTimeout(slow))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newHTTPServer(l.Addr().String(), mux, 100*time.Millisecond)
+	go s.Serve(l)
+	defer s.Close()
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if body, err := get("/unlimited"); err != nil || body != "first second" {
+		t.Errorf("Expected the whole response, got %q (%v)", body, err)
+	}
+	if body, err := get("/limited"); err == nil && body == "first second" {
+		t.Errorf("Expected the write timeout to cut off the response")
+	}
+}
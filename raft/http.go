@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	votePath     = "/raft/vote"
+	appendPath   = "/raft/append"
+	snapshotPath = "/raft/snapshot"
+)
+
+// HTTPTransport sends requests as JSON to the /raft/ endpoints served by
+// NewHTTPHandler. Peers maps node ids to base URLs like http://db1:8070.
+type HTTPTransport struct {
+	Peers  map[string]string
+	Client *http.Client
+}
+
+func NewHTTPTransport(peers map[string]string) *HTTPTransport {
+	return &HTTPTransport{Peers: peers, Client: http.DefaultClient}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, to string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	var resp RequestVoteResponse
+	err := t.call(ctx, to, votePath, req, &resp)
+	return resp, err
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, to string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	var resp AppendEntriesResponse
+	err := t.call(ctx, to, appendPath, req, &resp)
+	return resp, err
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, to string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	var resp InstallSnapshotResponse
+	err := t.call(ctx, to, snapshotPath, req, &resp)
+	return resp, err
+}
+
+func (t *HTTPTransport) call(ctx context.Context, to, path string, req, resp interface{}) error {
+	base, ok := t.Peers[to]
+	if !ok {
+		return ErrUnreachable
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("content-type", "application/json")
+	res, err := t.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", to, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// NewHTTPHandler serves the requests HTTPTransport sends to h. Mount it
+// at /raft/.
+func NewHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var resp interface{}
+		var err error
+		decoder := json.NewDecoder(r.Body)
+		switch r.URL.Path {
+		case votePath:
+			var req RequestVoteRequest
+			if err = decoder.Decode(&req); err == nil {
+				resp, err = h.HandleRequestVote(req)
+			}
+		case appendPath:
+			var req AppendEntriesRequest
+			if err = decoder.Decode(&req); err == nil {
+				resp, err = h.HandleAppendEntries(req)
+			}
+		case snapshotPath:
+			var req InstallSnapshotRequest
+			if err = decoder.Decode(&req); err == nil {
+				resp, err = h.HandleInstallSnapshot(req)
+			}
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to handle %s: %s", r.URL.Path, err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			log.Printf("Failed to write response to %s: %s", r.URL.Path, err)
+		}
+	})
+}
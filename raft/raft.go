@@ -0,0 +1,693 @@
+// Package raft replicates a log of commands between nodes with the Raft
+// consensus algorithm and applies the committed ones to a state machine.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxAppendEntries limits how many entries go in one AppendEntries request.
+const maxAppendEntries = 64
+
+var ErrNotLeader = fmt.Errorf("node is not the leader")
+var ErrLeadershipLost = fmt.Errorf("leadership lost before the command was applied")
+var ErrStopped = fmt.Errorf("node is stopped")
+
+// StateMachine receives the committed commands in log order. Snapshot and
+// Restore are never called concurrently with Apply.
+type StateMachine interface {
+	Apply(command []byte) error
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+type Config struct {
+	// ID names the node; Peers lists the ids of the other cluster members.
+	ID    string
+	Peers []string
+
+	Transport    Transport
+	Storage      Storage
+	StateMachine StateMachine
+
+	// A follower that hears nothing from a leader for a random time between
+	// ElectionTimeout and twice as long starts an election. A leader sends
+	// heartbeats every HeartbeatInterval, which must be a lot shorter.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries are kept in the log
+	// before it is compacted into a snapshot; 0 disables snapshots.
+	SnapshotThreshold uint64
+}
+
+type role int
+
+const (
+	roleFollower role = iota
+	roleCandidate
+	roleLeader
+)
+
+type proposal struct {
+	term   uint64
+	result chan error
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	mu     sync.Mutex
+	config Config
+	rand   *rand.Rand
+
+	role   role
+	term   uint64
+	vote   string
+	leader string
+	// log[0] stands for the snapshot: only its index and term are used.
+	log         []Entry
+	snapshot    Snapshot
+	commitIndex uint64
+	lastApplied uint64
+	// restore is set when an installed snapshot waits to be applied.
+	restore bool
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	kicks      map[string]chan bool
+	deadline   time.Time
+	waiting    map[uint64]proposal
+
+	applyCond *sync.Cond
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   bool
+	wg        sync.WaitGroup
+}
+
+// NewNode loads the state saved in the storage and starts the node as a
+// follower. The node must be reachable through the transport of its peers.
+func NewNode(config Config) (*Node, error) {
+	state, snapshot, entries, err := config.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:     config,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		term:       state.Term,
+		vote:       state.Vote,
+		snapshot:   snapshot,
+		log:        append([]Entry{{Index: snapshot.Index, Term: snapshot.Term}}, entries...),
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		kicks:      make(map[string]chan bool),
+		waiting:    make(map[uint64]proposal),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	if snapshot.Data != nil {
+		if err := config.StateMachine.Restore(bytes.NewReader(snapshot.Data)); err != nil {
+			return nil, err
+		}
+	}
+	n.commitIndex = snapshot.Index
+	n.lastApplied = snapshot.Index
+	n.resetDeadline()
+
+	n.wg.Add(2)
+	go n.tick()
+	go n.apply()
+	return n, nil
+}
+
+// Stop halts the node. Commands waiting to be applied fail with ErrStopped.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	n.cancel()
+	for index, p := range n.waiting {
+		p.result <- ErrStopped
+		delete(n.waiting, index)
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// Leader returns the id of the current leader, or "" if it is not known.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader tells whether the node is the leader of its term.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == roleLeader
+}
+
+// Propose appends command to the log and waits until it is applied,
+// returning the error of the state machine. Only the leader accepts
+// commands; others return ErrNotLeader.
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	if len(command) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.role != roleLeader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command}
+	if err := n.config.Storage.Append([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.log = append(n.log, e)
+	p := proposal{term: n.term, result: make(chan error, 1)}
+	n.waiting[e.Index] = p
+	n.kickAll()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, if the log still has it.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index < n.log[0].Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.log[0].Index].Term, true
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(n.rand.Int63n(int64(timeout))))
+}
+
+func (n *Node) saveState() error {
+	return n.config.Storage.SaveState(HardState{Term: n.term, Vote: n.vote})
+}
+
+// stepDown makes the node a follower, moving to term if it is newer.
+func (n *Node) stepDown(term uint64) {
+	if n.role == roleLeader {
+		for peer, kick := range n.kicks {
+			close(kick)
+			delete(n.kicks, peer)
+		}
+	}
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.leader = ""
+		if err := n.saveState(); err != nil {
+			log.Printf("Failed to save raft state: %s", err)
+		}
+	}
+	n.role = roleFollower
+}
+
+func (n *Node) quorum() int {
+	return (len(n.config.Peers)+1)/2 + 1
+}
+
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.role == roleLeader {
+			n.kickAll()
+		} else if time.Now().After(n.deadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) startElection() {
+	n.term++
+	n.role = roleCandidate
+	n.vote = n.config.ID
+	n.leader = ""
+	n.resetDeadline()
+	if err := n.saveState(); err != nil {
+		log.Printf("Failed to save raft state: %s", err)
+		n.role = roleFollower
+		return
+	}
+
+	req := RequestVoteRequest{
+		Term:         n.term,
+		CandidateID:  n.config.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.config.Peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+			defer cancel()
+			resp, err := n.config.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != roleCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = roleLeader
+	n.leader = n.config.ID
+	// An entry of the new term lets the entries of earlier ones commit.
+	noop := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if err := n.config.Storage.Append([]Entry{noop}); err != nil {
+		log.Printf("Failed to append to the raft log: %s", err)
+		n.role = roleFollower
+		n.leader = ""
+		return
+	}
+	n.log = append(n.log, noop)
+
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastIndex()
+		n.matchIndex[peer] = 0
+		kick := make(chan bool, 1)
+		n.kicks[peer] = kick
+		n.wg.Add(1)
+		go n.replicate(peer, n.term, kick)
+	}
+	n.kickAll()
+	n.advanceCommit()
+}
+
+// kickAll makes the replication goroutines send what followers miss, or
+// a heartbeat if they are up to date.
+func (n *Node) kickAll() {
+	for _, kick := range n.kicks {
+		select {
+		case kick <- true:
+		default:
+		}
+	}
+}
+
+// replicate sends entries to peer for as long as the node leads term.
+func (n *Node) replicate(peer string, term uint64, kick chan bool) {
+	defer n.wg.Done()
+	for {
+		select {
+		case _, ok := <-kick:
+			if !ok {
+				return
+			}
+		case <-n.ctx.Done():
+			return
+		}
+		for {
+			more, leading := n.sendTo(peer, term)
+			if !leading {
+				return
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// sendTo sends peer the entries it misses, or the snapshot if they are
+// gone from the log. It reports whether there is more to send right away
+// and whether the node still leads term.
+func (n *Node) sendTo(peer string, term uint64) (more, leading bool) {
+	n.mu.Lock()
+	if n.role != roleLeader || n.term != term || n.stopped {
+		n.mu.Unlock()
+		return false, false
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	defer cancel()
+
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		req := InstallSnapshotRequest{Term: term, LeaderID: n.config.ID, Snapshot: n.snapshot}
+		n.mu.Unlock()
+		resp, err := n.config.Transport.InstallSnapshot(ctx, peer, req)
+		if err != nil {
+			return false, true
+		}
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+		}
+		if n.role != roleLeader || n.term != term {
+			return false, false
+		}
+		if req.Snapshot.Index > n.matchIndex[peer] {
+			n.matchIndex[peer] = req.Snapshot.Index
+			n.nextIndex[peer] = req.Snapshot.Index + 1
+		}
+		return true, true
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	last := n.lastIndex()
+	if last-next+1 > maxAppendEntries {
+		last = next + maxAppendEntries - 1
+	}
+	req := AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.config.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      append([]Entry(nil), n.log[next-n.log[0].Index:last-n.log[0].Index+1]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+	resp, err := n.config.Transport.AppendEntries(ctx, peer, req)
+	if err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+	}
+	if n.role != roleLeader || n.term != term {
+		return false, false
+	}
+	if !resp.Success {
+		n.nextIndex[peer] = resp.ConflictIndex
+		if n.nextIndex[peer] < 1 {
+			n.nextIndex[peer] = 1
+		}
+		return true, true
+	}
+	if match := req.PrevLogIndex + uint64(len(req.Entries)); match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.nextIndex[peer] = match + 1
+	}
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex(), true
+}
+
+// advanceCommit commits the entries of the current term stored by a
+// majority, together with all entries before them.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) HandleRequestVote(req RequestVoteRequest) (RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return RequestVoteResponse{}, ErrStopped
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	resp := RequestVoteResponse{Term: n.term}
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex()
+	if req.Term < n.term || !upToDate || n.vote != "" && n.vote != req.CandidateID {
+		return resp, nil
+	}
+
+	n.vote = req.CandidateID
+	if err := n.saveState(); err != nil {
+		n.vote = ""
+		return RequestVoteResponse{}, err
+	}
+	n.resetDeadline()
+	resp.Granted = true
+	return resp, nil
+}
+
+// follow accepts the sender of a request of the current term as the leader.
+func (n *Node) follow(term uint64, leader string) {
+	n.stepDown(term)
+	n.leader = leader
+	n.resetDeadline()
+}
+
+func (n *Node) HandleAppendEntries(req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return AppendEntriesResponse{}, ErrStopped
+	}
+	if req.Term < n.term {
+		return AppendEntriesResponse{Term: n.term}, nil
+	}
+	n.follow(req.Term, req.LeaderID)
+	resp := AppendEntriesResponse{Term: n.term}
+
+	// Entries covered by the snapshot are committed, so they match.
+	entries := req.Entries
+	prev, prevTerm := req.PrevLogIndex, req.PrevLogTerm
+	if prev < n.log[0].Index {
+		for len(entries) > 0 && entries[0].Index <= n.log[0].Index {
+			entries = entries[1:]
+		}
+		prev, prevTerm = n.log[0].Index, n.log[0].Term
+	}
+	if prev > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term, _ := n.termAt(prev); term != prevTerm {
+		index := prev
+		for index-1 > n.log[0].Index {
+			if t, _ := n.termAt(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	for i, e := range entries {
+		if term, ok := n.termAt(e.Index); ok && term == e.Term {
+			continue
+		}
+		if err := n.config.Storage.Append(entries[i:]); err != nil {
+			return AppendEntriesResponse{}, err
+		}
+		n.log = appendEntries(n.log[:e.Index-n.log[0].Index], entries[i:])
+		break
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		last := req.PrevLogIndex + uint64(len(req.Entries))
+		if req.LeaderCommit < last {
+			last = req.LeaderCommit
+		}
+		if last > n.commitIndex {
+			n.commitIndex = last
+			n.applyCond.Broadcast()
+		}
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+func (n *Node) HandleInstallSnapshot(req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return InstallSnapshotResponse{}, ErrStopped
+	}
+	if req.Term < n.term {
+		return InstallSnapshotResponse{Term: n.term}, nil
+	}
+	n.follow(req.Term, req.LeaderID)
+	s := req.Snapshot
+	if s.Index <= n.commitIndex {
+		return InstallSnapshotResponse{Term: n.term}, nil
+	}
+
+	// Entries after the snapshot stay if the log agrees with it.
+	var entries []Entry
+	if term, ok := n.termAt(s.Index); ok && term == s.Term {
+		entries = append(entries, n.log[s.Index-n.log[0].Index+1:]...)
+	}
+	if err := n.config.Storage.SaveSnapshot(s, entries); err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	n.log = append([]Entry{{Index: s.Index, Term: s.Term}}, entries...)
+	n.snapshot = s
+	n.commitIndex = s.Index
+	n.restore = true
+	n.applyCond.Broadcast()
+	return InstallSnapshotResponse{Term: n.term}, nil
+}
+
+// apply hands committed entries and installed snapshots to the state
+// machine, and compacts the log once enough entries are applied.
+func (n *Node) apply() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.stopped && !n.restore && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+
+		if n.restore {
+			n.restore = false
+			s := n.snapshot
+			n.mu.Unlock()
+			err := n.config.StateMachine.Restore(bytes.NewReader(s.Data))
+			n.mu.Lock()
+			if err != nil {
+				// Entries after the snapshot cannot be applied to a state
+				// machine left behind it, so try again until it works.
+				log.Printf("Failed to restore raft snapshot %d, retrying: %s", s.Index, err)
+				n.restore = true
+				n.mu.Unlock()
+				select {
+				case <-n.ctx.Done():
+				case <-time.After(n.config.ElectionTimeout):
+				}
+				n.mu.Lock()
+				continue
+			}
+			n.lastApplied = s.Index
+			for index, p := range n.waiting {
+				if index <= s.Index {
+					p.result <- ErrLeadershipLost
+					delete(n.waiting, index)
+				}
+			}
+			continue
+		}
+
+		e := n.log[n.lastApplied+1-n.log[0].Index]
+		var err error
+		if len(e.Command) > 0 {
+			n.mu.Unlock()
+			err = n.config.StateMachine.Apply(e.Command)
+			n.mu.Lock()
+		}
+		n.lastApplied = e.Index
+		if p, ok := n.waiting[e.Index]; ok {
+			if p.term != e.Term {
+				err = ErrLeadershipLost
+			}
+			p.result <- err
+			delete(n.waiting, e.Index)
+		}
+
+		threshold := n.config.SnapshotThreshold
+		if threshold > 0 && n.lastApplied-n.log[0].Index >= threshold {
+			n.compact()
+		}
+	}
+}
+
+// compact replaces the applied entries with a snapshot. It is called by
+// the apply goroutine, so the state machine is at lastApplied.
+func (n *Node) compact() {
+	index := n.lastApplied
+	term, _ := n.termAt(index)
+	n.mu.Unlock()
+	var data bytes.Buffer
+	err := n.config.StateMachine.Snapshot(&data)
+	n.mu.Lock()
+	if err != nil {
+		log.Printf("Failed to take raft snapshot: %s", err)
+		return
+	}
+	if n.restore || index <= n.log[0].Index {
+		return
+	}
+
+	s := Snapshot{Index: index, Term: term, Data: data.Bytes()}
+	entries := append([]Entry(nil), n.log[index-n.log[0].Index+1:]...)
+	if err := n.config.Storage.SaveSnapshot(s, entries); err != nil {
+		log.Printf("Failed to save raft snapshot: %s", err)
+		return
+	}
+	n.log = append([]Entry{{Index: index, Term: term}}, entries...)
+	n.snapshot = s
+}
@@ -0,0 +1,312 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kv is a state machine of "key=value" commands.
+type kv struct {
+	mu       sync.Mutex
+	data     map[string]string
+	restores int
+	// failures is how many of the next restores fail.
+	failures int
+}
+
+func newKV() *kv {
+	return &kv{data: make(map[string]string)}
+}
+
+func (s *kv) Apply(command []byte) error {
+	parts := strings.SplitN(string(command), "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad command %q", command)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[parts[0]] = parts[1]
+	return nil
+}
+
+func (s *kv) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(w).Encode(s.data)
+}
+
+func (s *kv) Restore(r io.Reader) error {
+	data := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("restore failed")
+	}
+	s.data = data
+	s.restores++
+	return nil
+}
+
+func (s *kv) get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+type testCluster struct {
+	t        *testing.T
+	network  *MemNetwork
+	ids      []string
+	nodes    map[string]*Node
+	machines map[string]*kv
+	storage  map[string]*MemStorage
+}
+
+func newTestCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	c := &testCluster{
+		t:        t,
+		network:  NewMemNetwork(),
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*kv),
+		storage:  make(map[string]*MemStorage),
+	}
+	for i := 1; i <= size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.ids {
+		c.storage[id] = NewMemStorage()
+		c.start(id, snapshotThreshold)
+	}
+	return c
+}
+
+func (c *testCluster) start(id string, snapshotThreshold uint64) {
+	var peers []string
+	for _, peer := range c.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	c.machines[id] = newKV()
+	n, err := NewNode(Config{
+		ID:                id,
+		Peers:             peers,
+		Transport:         c.network.Transport(id),
+		Storage:           c.storage[id],
+		StateMachine:      c.machines[id],
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: snapshotThreshold,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+	c.network.Add(id, n)
+}
+
+func (c *testCluster) stop() {
+	for _, n := range c.nodes {
+		n.Stop()
+	}
+}
+
+// leader waits for exactly one node among ids to lead and returns it.
+func (c *testCluster) leader(ids ...string) string {
+	c.t.Helper()
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		var leaders []string
+		for _, id := range ids {
+			if c.nodes[id].IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("No single leader among %v", ids)
+	return ""
+}
+
+func (c *testCluster) propose(id, command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.nodes[id].Propose(ctx, []byte(command))
+}
+
+// applied waits until the state machines of ids have key set to value.
+func (c *testCluster) applied(key, value string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		deadline := time.Now().Add(3 * time.Second)
+		for c.machines[id].get(key) != value {
+			if time.Now().After(deadline) {
+				c.t.Fatalf("%s has %s=%q, expected %q", id, key, c.machines[id].get(key), value)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestNode_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.stop()
+
+	leader := c.leader()
+	for i := 0; i < 10; i++ {
+		if err := c.propose(leader, fmt.Sprintf("key%d=value%d", i%3, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.applied("key0", "value9", c.ids...)
+	c.applied("key2", "value8", c.ids...)
+
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		if err := c.propose(id, "key=value"); err != ErrNotLeader {
+			t.Errorf("Expected ErrNotLeader from follower %s, got %v", id, err)
+		}
+		if got := c.nodes[id].Leader(); got != leader {
+			t.Errorf("%s knows %q as the leader, expected %s", id, got, leader)
+		}
+	}
+	if err := c.propose(leader, "bad"); err == nil {
+		t.Error("Expected the error of the state machine")
+	}
+}
+
+func TestNode_Partition(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+	defer c.stop()
+
+	old := c.leader()
+	if err := c.propose(old, "key=before"); err != nil {
+		t.Fatal(err)
+	}
+	c.applied("key", "before", c.ids...)
+
+	var minority, majority []string
+	minority = append(minority, old)
+	for _, id := range c.ids {
+		if id != old {
+			if len(minority) < 2 {
+				minority = append(minority, id)
+			} else {
+				majority = append(majority, id)
+			}
+		}
+	}
+	c.network.Partition(minority, majority)
+
+	// The old leader cannot commit without a majority.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.nodes[old].Propose(ctx, []byte("key=lost")); err != context.DeadlineExceeded {
+		t.Errorf("Expected the minority leader to time out, got %v", err)
+	}
+
+	leader := c.leader(majority...)
+	if err := c.propose(leader, "key=after"); err != nil {
+		t.Fatal(err)
+	}
+	c.applied("key", "after", majority...)
+
+	c.network.Heal()
+	c.applied("key", "after", c.ids...)
+	if got := c.leader(); got != leader && !contains(majority, got) {
+		t.Errorf("Node %s of the minority became the leader", got)
+	}
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	defer c.stop()
+
+	leader := c.leader()
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader {
+			lagging = id
+		}
+	}
+	c.network.Remove(lagging)
+	for i := 0; i < 30; i++ {
+		if err := c.propose(leader, fmt.Sprintf("key%d=value%d", i%4, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := c.nodes[leader]
+	n.mu.Lock()
+	entries := len(n.log)
+	n.mu.Unlock()
+	if entries > 10 {
+		t.Errorf("The leader log was not compacted: %d entries", entries)
+	}
+
+	// A failed restore is retried instead of skipped.
+	m := c.machines[lagging]
+	m.mu.Lock()
+	m.failures = 2
+	m.mu.Unlock()
+	c.network.Add(lagging, c.nodes[lagging])
+	c.applied("key1", "value29", lagging)
+	c.applied("key2", "value26", lagging)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.restores == 0 {
+		t.Error("The lagging node caught up without a snapshot")
+	}
+}
+
+func TestNode_Restart(t *testing.T) {
+	c := newTestCluster(t, 3, 4)
+	defer c.stop()
+
+	leader := c.leader()
+	for i := 0; i < 10; i++ {
+		if err := c.propose(leader, fmt.Sprintf("key=value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.applied("key", "value9", c.ids...)
+
+	for _, id := range c.ids {
+		c.network.Remove(id)
+		c.nodes[id].Stop()
+	}
+	for _, id := range c.ids {
+		c.start(id, 4)
+	}
+	c.applied("key", "value9", c.ids...)
+	leader = c.leader()
+	if err := c.propose(leader, "key=restarted"); err != nil {
+		t.Fatal(err)
+	}
+	c.applied("key", "restarted", c.ids...)
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
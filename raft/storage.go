@@ -0,0 +1,270 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	stateFile    = "raft-state"
+	logFile      = "raft-log"
+	snapshotFile = "raft-snapshot"
+)
+
+// Entry is one command of the replicated log. Entries without a command
+// are no-ops a new leader appends to commit the entries of earlier terms.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// Snapshot is the state machine as of the entry Index of term Term.
+type Snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// HardState is what a node must remember to never vote twice in a term.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Storage keeps the state of a node across restarts. Every method must
+// have made its changes durable by the time it returns.
+type Storage interface {
+	// Load returns what was saved, or zero values for a new node.
+	Load() (HardState, Snapshot, []Entry, error)
+	SaveState(s HardState) error
+	// Append adds entries to the log, dropping the saved entries from the
+	// index of the first one on.
+	Append(entries []Entry) error
+	// SaveSnapshot saves s and replaces the log with entries, which
+	// follow the snapshot.
+	SaveSnapshot(s Snapshot, entries []Entry) error
+}
+
+// MemStorage keeps the state in memory, for tests.
+type MemStorage struct {
+	mu       sync.Mutex
+	state    HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snapshot, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemStorage) SaveState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = appendEntries(s.entries, entries)
+	return nil
+}
+
+func (s *MemStorage) SaveSnapshot(snapshot Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snapshot
+	s.entries = append([]Entry(nil), entries...)
+	return nil
+}
+
+// appendEntries adds entries to log, dropping those from the index of
+// the first one on.
+func appendEntries(log, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	for len(log) > 0 && log[len(log)-1].Index >= entries[0].Index {
+		log = log[:len(log)-1]
+	}
+	return append(log, entries...)
+}
+
+// FileStorage keeps the state in dir: the hard state and the snapshot in
+// files replaced as a whole, and the log as JSON Lines that are appended
+// to and only rewritten when entries are dropped.
+type FileStorage struct {
+	mu      sync.Mutex
+	dir     string
+	entries []Entry
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (s *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var state HardState
+	if err := s.readJSON(stateFile, &state); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	var snapshot Snapshot
+	if err := s.readJSON(snapshotFile, &snapshot); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+
+	s.entries = nil
+	f, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return state, snapshot, nil, nil
+	} else if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e Entry
+		if err := decoder.Decode(&e); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// A torn last entry was never acknowledged; new ones must not
+			// follow it.
+			if err := f.Truncate(decoder.InputOffset()); err != nil {
+				return HardState{}, Snapshot{}, nil, err
+			}
+			break
+		} else if err != nil {
+			return HardState{}, Snapshot{}, nil, fmt.Errorf("%s: %s", logFile, err)
+		}
+		s.entries = appendEntries(s.entries, []Entry{e})
+	}
+	return state, snapshot, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *FileStorage) SaveState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeJSON(stateFile, state)
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	if n := len(s.entries); n > 0 && s.entries[n-1].Index >= entries[0].Index {
+		return s.rewriteLog(appendEntries(append([]Entry(nil), s.entries...), entries))
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := writeEntries(f, entries); err != nil {
+		// Later entries must not follow a partly written one.
+		f.Truncate(info.Size())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *FileStorage) SaveSnapshot(snapshot Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeJSON(snapshotFile, snapshot); err != nil {
+		return err
+	}
+	return s.rewriteLog(append([]Entry(nil), entries...))
+}
+
+func (s *FileStorage) rewriteLog(entries []Entry) error {
+	err := s.replaceFile(logFile, func(w io.Writer) error {
+		return writeEntries(w, entries)
+	})
+	if err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+func writeEntries(w io.Writer, entries []Entry) error {
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	for _, e := range entries {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+func (s *FileStorage) readJSON(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+func (s *FileStorage) writeJSON(name string, v interface{}) error {
+	return s.replaceFile(name, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// replaceFile writes a temporary file and renames it over name, so that
+// a crash leaves either the old or the new content.
+func (s *FileStorage) replaceFile(name string, write func(w io.Writer) error) error {
+	path := filepath.Join(s.dir, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveState(HardState{Term: 3, Vote: "node2"}); err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1, Command: []byte("a=1")}, {Index: 3, Term: 2, Command: []byte("b=2")}}
+	if err := s.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	// A conflicting entry replaces the tail of the log.
+	if err := s.Append([]Entry{{Index: 3, Term: 3, Command: []byte("b=3")}, {Index: 4, Term: 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() (HardState, Snapshot, []Entry) {
+		s, err := NewFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, snapshot, entries, err := s.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state, snapshot, entries
+	}
+	state, _, loaded := load()
+	if state != (HardState{Term: 3, Vote: "node2"}) {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if fmt.Sprint(loaded) != fmt.Sprint([]Entry{entries[0], entries[1], {Index: 3, Term: 3, Command: []byte("b=3")}, {Index: 4, Term: 3}}) {
+		t.Errorf("Unexpected entries %v", loaded)
+	}
+
+	if err := s.SaveSnapshot(Snapshot{Index: 3, Term: 3, Data: []byte("state")}, []Entry{{Index: 4, Term: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	// An entry torn by a crash is dropped.
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"index":5,"te`)
+	f.Close()
+
+	_, snapshot, loaded := load()
+	if snapshot.Index != 3 || snapshot.Term != 3 || string(snapshot.Data) != "state" {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+	if len(loaded) != 1 || loaded[0].Index != 4 {
+		t.Errorf("Unexpected entries after the snapshot %v", loaded)
+	}
+
+	s, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]Entry{{Index: 5, Term: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, loaded := load(); len(loaded) != 2 || loaded[1].Index != 5 {
+		t.Errorf("Unexpected entries appended after a torn one %v", loaded)
+	}
+}
@@ -0,0 +1,152 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+var ErrUnreachable = fmt.Errorf("node is unreachable")
+
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type RequestVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leaderId"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+// AppendEntriesResponse tells a leader whose entries do not match where
+// to continue from: ConflictIndex is the first index of the term that
+// differs, or right after the end of a log that is too short.
+type AppendEntriesResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflictIndex"`
+}
+
+type InstallSnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	LeaderID string   `json:"leaderId"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Handler answers the requests nodes send each other. Node implements it.
+type Handler interface {
+	HandleRequestVote(req RequestVoteRequest) (RequestVoteResponse, error)
+	HandleAppendEntries(req AppendEntriesRequest) (AppendEntriesResponse, error)
+	HandleInstallSnapshot(req InstallSnapshotRequest) (InstallSnapshotResponse, error)
+}
+
+// Transport delivers requests to the Handler of the node with the given id.
+type Transport interface {
+	RequestVote(ctx context.Context, to string, req RequestVoteRequest) (RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, to string, req AppendEntriesRequest) (AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, to string, req InstallSnapshotRequest) (InstallSnapshotResponse, error)
+}
+
+// MemNetwork connects nodes of one process. Partition splits it so that
+// nodes reach only those in their own group, to test elections and
+// replication under network failures.
+type MemNetwork struct {
+	mu       sync.Mutex
+	handlers map[string]Handler
+	groups   map[string]int
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{handlers: make(map[string]Handler), groups: make(map[string]int)}
+}
+
+// Add connects the handler of node id, replacing the one it had before.
+func (m *MemNetwork) Add(id string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = h
+}
+
+// Remove disconnects node id, as if it crashed.
+func (m *MemNetwork) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, id)
+}
+
+// Partition splits the network into the given groups. Nodes left out of
+// all of them form one more group.
+func (m *MemNetwork) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			m.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (m *MemNetwork) Heal() {
+	m.Partition()
+}
+
+// Transport returns the transport node id sends its requests with.
+func (m *MemNetwork) Transport(id string) Transport {
+	return memTransport{network: m, from: id}
+}
+
+func (m *MemNetwork) handler(from, to string) (Handler, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.handlers[to]
+	if !ok || m.groups[from] != m.groups[to] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type memTransport struct {
+	network *MemNetwork
+	from    string
+}
+
+func (t memTransport) RequestVote(ctx context.Context, to string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	h, err := t.network.handler(t.from, to)
+	if err != nil {
+		return RequestVoteResponse{}, err
+	}
+	return h.HandleRequestVote(req)
+}
+
+func (t memTransport) AppendEntries(ctx context.Context, to string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	h, err := t.network.handler(t.from, to)
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	return h.HandleAppendEntries(req)
+}
+
+func (t memTransport) InstallSnapshot(ctx context.Context, to string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	h, err := t.network.handler(t.from, to)
+	if err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	return h.HandleInstallSnapshot(req)
+}